@@ -0,0 +1,126 @@
+package dagor
+
+import (
+	"sync/atomic"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// UnknownMethodPolicy tells an entry service how to assign B to a method missing from the business map.
+type UnknownMethodPolicy int
+
+const (
+	// UnknownMethodRandom assigns a random B, once per method and process.
+	UnknownMethodRandom UnknownMethodPolicy = iota
+	// UnknownMethodDefault assigns DefaultBusiness, or Bmax if it is not set.
+	UnknownMethodDefault
+	// UnknownMethodReject rejects the request with InvalidArgument.
+	UnknownMethodReject
+	// UnknownMethodHash derives B from a hash of the method name, the same on every replica and after restarts.
+	UnknownMethodHash
+)
+
+// maxUnclassifiedMethods bounds the number of methods tracked in unclassifiedMethods. The method name can come
+// from the method override of the caller, so without a bound a client sending random names could grow it forever.
+const maxUnclassifiedMethods = 1024
+
+// OtherUnclassifiedMethods is the key UnclassifiedMethods counts the requests of the methods under once
+// maxUnclassifiedMethods methods are tracked.
+const OtherUnclassifiedMethods = "*"
+
+// unclassifiedMethod is the B assigned to a method missing from the business map, and its request count.
+type unclassifiedMethod struct {
+	B        int
+	requests int64
+}
+
+// unknownBusiness assigns B to a method missing from the business map according to the unknown method policy,
+// and counts the request. The assigned B is kept in unclassifiedMethods instead of the business map, which
+// concurrent requests read without a lock.
+func (d *Dagor) unknownBusiness(methodName string) (int, error) {
+	if d.unknownMethodPolicy == UnknownMethodReject && d.dryRun {
+		// serve the request as UnknownMethodDefault would
+		d.recordDryRunPolicyDrop(methodName, ReasonUnknownMethod)
+		B, _ := d.countUnclassified(methodName, d.lowestBusiness())
+		return B, nil
+	}
+	if d.unknownMethodPolicy == UnknownMethodReject {
+		d.countUnclassified(methodName, 0)
+		logger("[Entry service] Entry service can't find Business value for method %s, rejected the request", methodName)
+		return 0, status.Errorf(codes.InvalidArgument, "Business value for method %s not found", methodName)
+	}
+	if m, ok := d.unclassifiedMethods.Load(methodName); ok {
+		atomic.AddInt64(&m.(*unclassifiedMethod).requests, 1)
+		return m.(*unclassifiedMethod).B, nil
+	}
+	var B int
+	switch d.unknownMethodPolicy {
+	case UnknownMethodDefault:
+		B = d.lowestBusiness()
+	case UnknownMethodHash:
+		B = int(hashString(methodName)%uint64(d.Bmax)) + 1
+	default:
+		// assign a random business value between 1 and Bmax
+		B = d.randIntn(d.Bmax) + 1
+		// make sure the business value is not yet assigned
+		for _, v := range d.businessMap {
+			if v == B {
+				B = d.randIntn(d.Bmax) + 1
+			}
+		}
+	}
+	B, added := d.countUnclassified(methodName, B)
+	if added {
+		logger("[Entry service] Entry service can't find Business value for method %s, assigned value %d", methodName, B)
+	}
+	return B, nil
+}
+
+// countUnclassified counts a request to a method missing from the business map, tracking the method with
+// the given B if it is new. It returns the B of the method, the given one if the method is not tracked,
+// and whether it was added. Beyond maxUnclassifiedMethods methods, the request is counted under
+// OtherUnclassifiedMethods instead, and the B of a new method is not kept.
+func (d *Dagor) countUnclassified(methodName string, B int) (int, bool) {
+	val, ok := d.unclassifiedMethods.Load(methodName)
+	added := false
+	if !ok {
+		if d.unclassifiedCount.Add(1) > maxUnclassifiedMethods {
+			d.unclassifiedCount.Add(-1)
+			d.unclassifiedOverflow.Add(1)
+			return B, false
+		}
+		val, ok = d.unclassifiedMethods.LoadOrStore(methodName, &unclassifiedMethod{B: B})
+		if ok {
+			d.unclassifiedCount.Add(-1)
+		}
+		added = !ok
+	}
+	m := val.(*unclassifiedMethod)
+	atomic.AddInt64(&m.requests, 1)
+	return m.B, added
+}
+
+// lowestBusiness returns the B of the methods missing from the business map under UnknownMethodDefault:
+// DefaultBusiness, or Bmax if it is not set.
+func (d *Dagor) lowestBusiness() int {
+	if d.defaultBusiness < 1 || d.defaultBusiness > d.Bmax {
+		return d.Bmax
+	}
+	return d.defaultBusiness
+}
+
+// UnclassifiedMethods returns the number of requests the entry service received for each method missing
+// from the business map, so that the configuration can be completed. Requests to methods beyond the first
+// 1024 are counted under OtherUnclassifiedMethods.
+func (d *Dagor) UnclassifiedMethods() map[string]int64 {
+	methods := make(map[string]int64)
+	d.unclassifiedMethods.Range(func(key, value interface{}) bool {
+		methods[key.(string)] = atomic.LoadInt64(&value.(*unclassifiedMethod).requests)
+		return true
+	})
+	if other := d.unclassifiedOverflow.Load(); other > 0 {
+		methods[OtherUnclassifiedMethods] = other
+	}
+	return methods
+}
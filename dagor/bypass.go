@@ -0,0 +1,17 @@
+package dagor
+
+import "strings"
+
+// bypassed reports whether a method is exempt from DAGOR, like health checks, reflection or admin calls.
+// Both interceptors pass such calls through without metadata requirements, accounting or shedding.
+func (d *Dagor) bypassed(method string) bool {
+	if d.bypassMethods[method] {
+		return true
+	}
+	for _, prefix := range d.bypassPrefixes {
+		if strings.HasPrefix(method, prefix) {
+			return true
+		}
+	}
+	return false
+}
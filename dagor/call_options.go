@@ -0,0 +1,81 @@
+package dagor
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+)
+
+// userIDCallOption carries the user ID of one call through the end user interceptor.
+type userIDCallOption struct {
+	grpc.EmptyCallOption
+	userID string
+}
+
+// businessCallOption carries the business priority hint of one call through the end user interceptor.
+type businessCallOption struct {
+	grpc.EmptyCallOption
+	B int
+}
+
+// WithUserID sends the call for the given user instead of the ID of the end user node, for clients that
+// multiplex several users, like a backend for frontend or a load generator.
+func WithUserID(userID string) grpc.CallOption {
+	return userIDCallOption{userID: userID}
+}
+
+// WithBusiness hints the business priority B of the call. Entry services only honor it with AcceptBusinessHints.
+func WithBusiness(B int) grpc.CallOption {
+	return businessCallOption{B: B}
+}
+
+type userIDKey struct{}
+
+// ContextWithUserID attaches the ID of the user a request is sent for to ctx. The end user interceptor sends it
+// unless the call has a WithUserID option.
+func ContextWithUserID(ctx context.Context, userID string) context.Context {
+	return context.WithValue(ctx, userIDKey{}, userID)
+}
+
+// UserIDFromContext returns the user ID attached to ctx by ContextWithUserID.
+func UserIDFromContext(ctx context.Context) (string, bool) {
+	userID, ok := ctx.Value(userIDKey{}).(string)
+	return userID, ok && userID != ""
+}
+
+// callUserID returns the user ID of an end user call: the WithUserID option, else the user ID of the context,
+// else the ID of this node.
+func (d *Dagor) callUserID(ctx context.Context, opts []grpc.CallOption) string {
+	for i := len(opts) - 1; i >= 0; i-- {
+		if o, ok := opts[i].(userIDCallOption); ok {
+			return o.userID
+		}
+	}
+	if userID, ok := UserIDFromContext(ctx); ok {
+		return userID
+	}
+	return d.uuid
+}
+
+// callBusiness returns the business priority hint of an end user call, if it has one.
+func callBusiness(opts []grpc.CallOption) (int, bool) {
+	for i := len(opts) - 1; i >= 0; i-- {
+		if o, ok := opts[i].(businessCallOption); ok {
+			return o.B, true
+		}
+	}
+	return 0, false
+}
+
+// hintedBusiness returns the business priority hint sent by the end user, if the entry service accepts
+// hints and it is within [1, Bmax].
+func (d *Dagor) hintedBusiness(ctx context.Context) (int, bool) {
+	if !d.acceptBusinessHints {
+		return 0, false
+	}
+	v, ok := incomingValue(ctx, d.businessKey)
+	if !ok {
+		return 0, false
+	}
+	return parsePriority(v, d.Bmax)
+}
@@ -2,8 +2,8 @@ package dagor
 
 import (
 	"context"
-	"errors"
 	"strconv"
+	"sync"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -16,92 +16,216 @@ type ThresholdTable struct {
 	UStar int
 }
 
+const msgLocalReject = "[Local Admission Control] B or U values do not meet the threshold B* or U*, request dropped"
+
+var (
+	errNoOutgoingB = status.Error(codes.InvalidArgument, "B or U not found in metadata, fatal error")
+)
+
+// UnaryInterceptorClient is the DAGOR client interceptor. For DAGOR nodes, the local admission decision
+// does not allocate: the outgoing metadata is read in place and the drop errors are shared per threshold,
+// so dropping a sub-request is allocation free. Forwarding an admitted one allocates only within
+// metadata.AppendToOutgoingContext: the priority is encoded once per request being served, and the response
+// header is captured with pooled call options (TestInterceptorAllocs).
 func (d *Dagor) UnaryInterceptorClient(ctx context.Context, method string, req interface{}, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if d.bypassed(method) {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
 	// if d.isEnduser, attach user id to metadata and send request
 	if d.isEnduser {
-		ctx = metadata.AppendToOutgoingContext(ctx, "user-id", d.uuid)
-		err := invoker(ctx, method, req, reply, cc, opts...)
+		userID := d.callUserID(ctx, opts)
+		B, hinted := callBusiness(opts)
+		if hinted {
+			ctx = metadata.AppendToOutgoingContext(ctx, UserIDKey, userID, d.businessKey, strconv.Itoa(B))
+		} else {
+			ctx = metadata.AppendToOutgoingContext(ctx, UserIDKey, userID)
+		}
+		var err error
+		if d.preThrottle {
+			key := entryLevelKey{method: method, userID: userID, hint: B}
+			if err := d.preThrottleReject(key); err != nil {
+				if !d.dryRun {
+					if debug {
+						logger("[End User] %s dropped a request to %s locally, the entry service is shedding its priority", userID, method)
+					}
+					return err
+				}
+				d.recordDryRunDrop(method, err)
+			}
+			// the entry service echoes the priority and admission level on rejections too
+			var header metadata.MD
+			header, err = invokeWithHeader(ctx, method, req, reply, cc, invoker, opts)
+			d.learnEntryLevel(key, header)
+		} else {
+			err = invoker(ctx, method, req, reply, cc, opts...)
+		}
 		if err != nil {
-			logger("[End User] %s is an end user, req got error: %v", d.uuid, err)
+			logger("[End User] %s is an end user, req got error: %v", userID, err)
 			return err
 		}
-		logger("[End User] %s is an end user, req completed", d.uuid)
+		if debug {
+			logger("[End User] %s is an end user, req completed", userID)
+		}
 		return nil
 	}
 
-	// Extracting metadata
-	md, ok := metadata.FromOutgoingContext(ctx)
-	if !ok {
-		return errors.New("could not retrieve metadata from context")
-	}
-
 	// Extracting method name and determining B value
-	methodName, ok := md["method"]
-	if !ok || len(methodName) == 0 {
-		return errors.New("method name not found in metadata")
+	methodName, ok := outgoingValue(ctx, "method")
+	if !ok {
+		methodName = method
 	}
 
-	// Check if B and U are in the metadata
-	BValues, BExists := md["b"]
-	UValues, UExists := md["u"]
-
-	if !BExists || !UExists {
-		// if B or U not in metadata, this client is end user, otherwise, fatal error
-		if !d.isEnduser {
+	// Check if B and U are in the context or the metadata
+	p, ok := d.outgoingPriority(ctx)
+	if !ok {
+		// this client is a DAGOR node in the service app, B and U must have been set by the entry service
+		if debug {
 			logger("[Client Sending Req] not an enduser and B or U not found in metadata, fatal error")
-			return status.Errorf(codes.InvalidArgument, "B or U not found in metadata, fatal error")
 		}
-		// // mark this client as end user
-		// d.isEnduser = true
-		// logger("No B or U received. Client %s marked as an end user", d.uuid)
-		// // attach user id to metadata
-		// ctx = metadata.AppendToOutgoingContext(ctx, "user-id", d.uuid)
-		// err := invoker(ctx, method, req, reply, cc, opts...)
-		// if err != nil {
-		// 	return err
-		// }
-		// return nil
-	}
-
-	var B, U int
-	// otherwise, this client is a DAGOR node in the service app
-	B, _ = strconv.Atoi(BValues[0])
-	U, _ = strconv.Atoi(UValues[0])
+		return errNoOutgoingB
+	}
+	B, U := p.B, p.U
+
 	// check if B and U against threshold table before sending sub-request
-	// Thresholding
-
-	val, ok := d.thresholdTable.Load(methodName[0])
-	if ok {
-		threshold := val.(thresholdVal)
-		if B > threshold.Bstar || (B == threshold.Bstar && U > threshold.Ustar) {
-			logger("[Ratelimiting] B %d or U %d value above the threshold B* %d or U* %d, request dropped", B, U, threshold.Bstar, threshold.Ustar)
-			return status.Errorf(codes.ResourceExhausted, "[Local Admission Control] B or U values do not meet the threshold B* or U*, request dropped")
+	if err := d.localReject(methodName, B, U); err != nil {
+		if !d.dryRun {
+			if debug {
+				logger("[Ratelimiting] B %d or U %d value above the threshold B* or U* of method %s, request dropped", B, U, methodName)
+			}
+			return err
 		}
-		logger("[Ratelimiting] B %d and U %d values below the threshold B* %d and U* %d, request sent", B, U, threshold.Bstar, threshold.Ustar)
+		d.recordDryRunDrop(methodName, err)
+	} else if debug {
+		logger("[Ratelimiting] B %d and U %d values below the threshold B* and U* of method %s, request sent", B, U, methodName)
+	}
+
+	// Modify ctx with the B and U, one hop further from the entry service, signed for the method called
+	if sig := d.signPriority(p, method); sig != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, d.priorityKey, forwardedPriority(ctx, p), d.signatureKey, sig)
 	} else {
-		logger("[Ratelimiting] B* and U* values not found in the threshold table for method %s.", methodName[0])
-		// return status.Errorf(codes.ResourceExhausted, "B* and U* values not found in the threshold table, request dropped")
+		ctx = metadata.AppendToOutgoingContext(ctx, d.priorityKey, forwardedPriority(ctx, p))
+	}
+	if d.sendLegacyMetadata {
+		if _, ok := outgoingValue(ctx, legacyBKey); !ok {
+			ctx = metadata.AppendToOutgoingContext(ctx, legacyBKey, strconv.Itoa(B), legacyUKey, strconv.Itoa(U))
+		}
 	}
-	// Modify ctx with the B and U
-	// ctx = metadata.AppendToOutgoingContext(ctx, "b", strconv.Itoa(B), "u", strconv.Itoa(U))
 
 	// Invoking the gRPC call
-	var header metadata.MD
-	err := invoker(ctx, method, req, reply, cc, grpc.Header(&header))
+	header, err := invokeWithHeader(ctx, method, req, reply, cc, invoker, opts)
 	if err != nil {
 		return err
 	}
 
 	// Store received B* and U* values from the header
-	BstarValues := header.Get("b-star")
-	UstarValues := header.Get("u-star")
-	if len(BstarValues) > 0 && len(UstarValues) > 0 {
-		Bstar, _ := strconv.Atoi(BstarValues[0])
-		Ustar, _ := strconv.Atoi(UstarValues[0])
-		d.thresholdTable.Store(methodName[0], thresholdVal{Bstar: Bstar, Ustar: Ustar})
-		// d.thresholdTable[methodName[0]] = thresholdVal{Bstar: Bstar, Ustar: Ustar}
-		logger("Received B* and U* values from the header: B*=%d, U*=%d", Bstar, Ustar)
+	if Bstar, Ustar, ok := d.receivedLevel(header); ok {
+		d.StoreThreshold(methodName, Bstar, Ustar)
+		if debug {
+			logger("Received B* and U* values from the header: B*=%d, U*=%d", Bstar, Ustar)
+		}
 	}
 
 	return nil
 }
+
+// outgoingPriority returns the priority of a sub-request: the one of the request being served by the
+// server interceptor, else the one set in the outgoing metadata, either binary or legacy.
+func (d *Dagor) outgoingPriority(ctx context.Context) (Priority, bool) {
+	if p, ok := PriorityFromContext(ctx); ok {
+		return p, true
+	}
+	if v, ok := lastOutgoingValue(ctx, d.priorityKey); ok {
+		return decodePriority(v)
+	}
+	BValue, BExists := outgoingValue(ctx, legacyBKey)
+	UValue, UExists := outgoingValue(ctx, legacyUKey)
+	if !BExists || !UExists {
+		return Priority{}, false
+	}
+	B, _ := parseUint(BValue)
+	U, _ := parseUint(UValue)
+	return Priority{B: B, U: U}, true
+}
+
+// forwardedPriority returns the encoded priority of a sub-request, one hop further than p. The priority of the
+// request being served is encoded once for all its sub-requests.
+func forwardedPriority(ctx context.Context, p Priority) string {
+	if c, ok := priorityFrom(ctx); ok {
+		return c.forwardedPriority()
+	}
+	p.Hops++
+	return encodePriority(p)
+}
+
+// headerCapture collects the response header of a call. It is pooled together with the call options it is
+// added to, so that learning the admission level of a downstream does not allocate.
+type headerCapture struct {
+	header metadata.MD
+	opts   []grpc.CallOption
+}
+
+var headerCapturePool = sync.Pool{New: func() interface{} { return new(headerCapture) }}
+
+// invokeWithHeader invokes a call and returns its response header. gRPC has set the header, and is done
+// with the call options, when a unary invoker returns.
+func invokeWithHeader(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts []grpc.CallOption) (metadata.MD, error) {
+	h := headerCapturePool.Get().(*headerCapture)
+	h.opts = append(append(h.opts[:0], opts...), grpc.Header(&h.header))
+	err := invoker(ctx, method, req, reply, cc, h.opts...)
+	header := h.header
+	h.header = nil
+	clear(h.opts)
+	headerCapturePool.Put(h)
+	return header, err
+}
+
+// receivedLevel reads the B* and U* piggybacked on a response header, binary or legacy.
+func (d *Dagor) receivedLevel(header metadata.MD) (int, int, bool) {
+	if vals := header[d.levelKey]; len(vals) > 0 {
+		return decodeLevel(vals[len(vals)-1])
+	}
+	BstarValues := header[legacyBstarKey]
+	UstarValues := header[legacyUstarKey]
+	if len(BstarValues) == 0 || len(UstarValues) == 0 {
+		return 0, 0, false
+	}
+	Bstar, _ := parseUint(BstarValues[0])
+	Ustar, _ := parseUint(UstarValues[0])
+	return Bstar, Ustar, true
+}
+
+// LocalAdmit reports whether a sub-request with priority (B, U) to the given downstream method passes
+// the last B* and U* learned from that downstream. Methods without a learned threshold are always admitted.
+func (d *Dagor) LocalAdmit(method string, B, U int) bool {
+	val, ok := d.thresholdTable.Load(method)
+	if !ok {
+		return true
+	}
+	threshold := val.(thresholdVal)
+	return Admits(B, U, threshold.Bstar, threshold.Ustar)
+}
+
+// localReject returns the error dropping a sub-request with priority (B, U) to the given downstream method,
+// or nil if LocalAdmit admits it.
+func (d *Dagor) localReject(method string, B, U int) error {
+	val, ok := d.thresholdTable.Load(method)
+	if !ok {
+		return nil
+	}
+	threshold := val.(thresholdVal)
+	if Admits(B, U, threshold.Bstar, threshold.Ustar) {
+		return nil
+	}
+	return threshold.rejections.get(B, U)
+}
+
+// StoreThreshold records the B* and U* piggybacked by a downstream in the threshold table.
+func (d *Dagor) StoreThreshold(method string, Bstar, Ustar int) {
+	// most responses carry an unchanged threshold, skip storing (and boxing) it again
+	if val, ok := d.thresholdTable.Load(method); ok {
+		if threshold := val.(thresholdVal); threshold.Bstar == Bstar && threshold.Ustar == Ustar {
+			return
+		}
+	}
+	d.thresholdTable.Store(method, thresholdVal{Bstar: Bstar, Ustar: Ustar, rejections: d.newRejections(ReasonLocalDrop, msgLocalReject, Bstar, Ustar)})
+}
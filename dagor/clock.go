@@ -0,0 +1,127 @@
+package dagor
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock abstracts the time source used by a DAGOR node, so that admission level
+// transitions can be driven by a fake clock in tests and simulations.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is the subset of time.Ticker used by DAGOR.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock is the default Clock backed by the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+type realTicker struct{ t *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+
+func (t realTicker) Stop() { t.t.Stop() }
+
+// FakeClock is a Clock whose time only moves when Advance is called.
+// Tickers created from it fire once for every period crossed by Advance.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+// NewFakeClock creates a FakeClock starting at the given time.
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+// Now returns the current fake time.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTicker creates a ticker that fires every d of fake time.
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for FakeClock.NewTicker")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{
+		clock:  c,
+		period: d,
+		next:   c.now.Add(d),
+		// unbuffered, so Advance blocks until the consumer has received each tick
+		ch:      make(chan time.Time),
+		stopped: make(chan struct{}),
+	}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// Advance moves the fake time forward by d, firing every tick that falls into the interval in order.
+// A tick is delivered only once its consumer receives it, so a loop driven by the ticker has started
+// processing each tick by the time Advance returns.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	target := c.now.Add(d)
+	c.mu.Unlock()
+	for {
+		c.mu.Lock()
+		// find the earliest pending tick up to the target time
+		var next *fakeTicker
+		for _, t := range c.tickers {
+			if !t.next.After(target) && (next == nil || t.next.Before(next.next)) {
+				next = t
+			}
+		}
+		if next == nil {
+			c.now = target
+			c.mu.Unlock()
+			return
+		}
+		c.now = next.next
+		next.next = next.next.Add(next.period)
+		now := c.now
+		c.mu.Unlock()
+		select {
+		case next.ch <- now:
+		case <-next.stopped:
+		}
+	}
+}
+
+type fakeTicker struct {
+	clock   *FakeClock
+	period  time.Duration
+	next    time.Time
+	ch      chan time.Time
+	stopped chan struct{}
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.ch }
+
+// Stop removes the ticker from its clock; no more ticks are delivered afterwards.
+func (t *fakeTicker) Stop() {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, other := range c.tickers {
+		if other == t {
+			c.tickers = append(c.tickers[:i], c.tickers[i+1:]...)
+			close(t.stopped)
+			return
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package dagor
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestFakeClockAdvanceDeliversTicksInOrder(t *testing.T) {
+	start := time.Unix(0, 0)
+	clock := NewFakeClock(start)
+	slow := clock.NewTicker(3 * time.Second)
+	fast := clock.NewTicker(2 * time.Second)
+	defer slow.Stop()
+	defer fast.Stop()
+
+	ticks := make(chan string)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case now := <-slow.C():
+				ticks <- fmt.Sprintf("slow@%v", now.Sub(start))
+			case now := <-fast.C():
+				ticks <- fmt.Sprintf("fast@%v", now.Sub(start))
+			case <-stop:
+				return
+			}
+		}
+	}()
+	var got []string
+	done := make(chan struct{})
+	go func() {
+		clock.Advance(6 * time.Second)
+		close(done)
+	}()
+	// tickers due at the same time fire in creation order
+	want := []string{"fast@2s", "slow@3s", "fast@4s", "slow@6s", "fast@6s"}
+	for range want {
+		got = append(got, <-ticks)
+	}
+	<-done
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ticks %v, want %v", got, want)
+	}
+	if now := clock.Now(); !now.Equal(start.Add(6 * time.Second)) {
+		t.Errorf("Now() = %v after Advance, want %v", now, start.Add(6*time.Second))
+	}
+}
+
+func TestFakeClockStopUnblocksAdvance(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	ticker := clock.NewTicker(time.Second)
+	done := make(chan struct{})
+	go func() {
+		// nobody receives the ticks, Advance blocks on the first one until the ticker is stopped
+		clock.Advance(10 * time.Second)
+		close(done)
+	}()
+	ticker.Stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Advance still blocked after the ticker was stopped")
+	}
+	select {
+	case tick := <-ticker.C():
+		t.Errorf("stopped ticker fired at %v", tick)
+	default:
+	}
+}
+
+func TestFakeClockDrivesAdmissionLevelUpdates(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	d := NewDagorNode(DagorParam{NodeName: "clocked", Bmax: 2, Umax: 4, AdmissionLevelUpdateInterval: time.Second,
+		QueuingThresh: time.Millisecond, Alpha: 0.5, Beta: 0.01, Clock: clock, MaxConcurrency: 1})
+	// hold the only slot, so that the next request waits in the queue of the scheduler
+	if err := d.acquireSlot(context.Background(), 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	for B := 1; B <= 2; B++ {
+		for U := 1; U <= 4; U++ {
+			d.UpdateHistogram(true, B, U)
+		}
+	}
+	waiting := make(chan error)
+	go func() { waiting <- d.acquireSlot(context.Background(), 1, 1) }()
+	for {
+		d.scheduler.mu.Lock()
+		queued := len(d.scheduler.queue)
+		d.scheduler.mu.Unlock()
+		if queued == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// the waiting request has been queued for a whole window when the tick fires; Advance returns once the
+	// update loop received the tick, not once it published the new level
+	clock.Advance(time.Second)
+	deadline := time.Now().Add(5 * time.Second)
+	for Bstar, Ustar := d.AdmissionLevel(); Bstar == 2 && Ustar == 4; Bstar, Ustar = d.AdmissionLevel() {
+		if time.Now().After(deadline) {
+			t.Fatal("admission level still (2, 4) after an overloaded window")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	d.releaseSlot()
+	if err := <-waiting; err != nil {
+		t.Fatal(err)
+	}
+	d.releaseSlot()
+}
+
+// seededRun runs a seeded entry node through a few windows of requests from the same users, to methods missing
+// from its business map, and returns the priorities it assigned, its admission decisions and level transitions.
+func seededRun(seed int64) []string {
+	clock := NewFakeClock(time.Unix(0, 0))
+	d := NewDagorNode(DagorParam{NodeName: "seeded", Bmax: 4, Umax: 8, AdmissionLevelUpdateInterval: time.Second,
+		QueuingThresh: time.Millisecond, Alpha: 0.3, Beta: 0.01, EntryService: true, ManualUpdate: true,
+		Clock: clock, RandSource: rand.NewSource(seed)})
+	var trace []string
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		p, _ := PriorityFromContext(ctx)
+		trace = append(trace, fmt.Sprintf("admit B=%d U=%d", p.B, p.U))
+		return nil, nil
+	}
+	for window := 0; window < 6; window++ {
+		for user := 0; user < 10; user++ {
+			method := fmt.Sprintf("/seeded.Service/Method%d", user%3)
+			ctx := grpc.NewContextWithServerTransportStream(context.Background(), benchStream{})
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(UserIDKey, fmt.Sprintf("user%d", user)))
+			if _, err := d.UnaryInterceptorServer(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, handler); err != nil {
+				trace = append(trace, "drop "+err.Error())
+			}
+		}
+		delay := time.Duration(0)
+		if window < 3 {
+			delay = 10 * time.Millisecond
+		}
+		Bstar, Ustar := d.AdjustAdmissionLevel(delay)
+		trace = append(trace, fmt.Sprintf("level %d %d", Bstar, Ustar))
+		clock.Advance(time.Second)
+	}
+	return trace
+}
+
+func TestSeededNodeIsReproducible(t *testing.T) {
+	first, second := seededRun(7), seededRun(7)
+	if !reflect.DeepEqual(first, second) {
+		t.Fatalf("two runs with the same seed differ:\n%v\n%v", first, second)
+	}
+	levels := map[string]bool{}
+	for _, line := range first {
+		if strings.HasPrefix(line, "level") {
+			levels[line] = true
+		}
+	}
+	if len(levels) < 2 {
+		t.Errorf("the admission level never changed, the run does not exercise the transitions: %v", levels)
+	}
+	if reflect.DeepEqual(first, seededRun(8)) {
+		t.Error("runs with different seeds assigned the same priorities")
+	}
+}
@@ -0,0 +1,38 @@
+package dagor
+
+import (
+	"testing"
+	"time"
+)
+
+// benchmarkUpdateHistogram measures the per-request cost of the counters under contention, every goroutine
+// recording requests with the same B, U pair, as when one business and user class dominates the traffic.
+func benchmarkUpdateHistogram(b *testing.B, params DagorParam) {
+	params.NodeName = "bench"
+	params.Bmax = 20
+	params.Umax = 128
+	params.AdmissionLevelUpdateInterval = time.Second
+	params.ManualUpdate = true
+	d := NewDagorNode(params)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		admitted := false
+		for pb.Next() {
+			admitted = !admitted
+			d.UpdateHistogram(admitted, 1, 1)
+		}
+	})
+}
+
+func BenchmarkUpdateHistogramMatrix(b *testing.B) {
+	benchmarkUpdateHistogram(b, DagorParam{})
+}
+
+func BenchmarkUpdateHistogramSyncMap(b *testing.B) {
+	benchmarkUpdateHistogram(b, DagorParam{UseSyncMap: true})
+}
+
+func BenchmarkUpdateHistogramSharded(b *testing.B) {
+	benchmarkUpdateHistogram(b, DagorParam{UseShardedCounters: true})
+}
@@ -0,0 +1,57 @@
+package dagor
+
+import (
+	"sync/atomic"
+)
+
+// Reasons of the dry-run records of the requests an entry or signature policy would have rejected.
+// Unlike ReasonServerReject and ReasonLocalDrop, they never appear in the status of an actual rejection,
+// which is an InvalidArgument or PermissionDenied error.
+const (
+	ReasonInvalidSignature = "DAGOR_INVALID_SIGNATURE" // Priority not signed with one of SigningKeys, under SignatureReject
+	ReasonUnknownMethod    = "DAGOR_UNKNOWN_METHOD"    // Method missing from BusinessMap, under UnknownMethodReject
+	ReasonNoUserID         = "DAGOR_NO_USER_ID"        // No user ID found, under UserIDReject
+)
+
+// DryRunDrop is a request that DAGOR would have dropped, had it not been in dry-run mode.
+type DryRunDrop struct {
+	Method string
+	Rejection
+}
+
+// recordDryRunDrop records a request the dry-run mode admits in spite of the rejection err.
+func (d *Dagor) recordDryRunDrop(method string, err error) {
+	r, _ := RejectionInfo(err)
+	d.recordDryRunRejection(method, r)
+}
+
+// recordDryRunPolicyDrop records a request the dry-run mode serves although a policy would have rejected it.
+func (d *Dagor) recordDryRunPolicyDrop(method, reason string) {
+	d.recordDryRunRejection(method, Rejection{Reason: reason, Node: d.nodeName})
+}
+
+// recordDryRunRejection counts a would-be drop by reason and reports it to onDryRunDrop.
+func (d *Dagor) recordDryRunRejection(method string, r Rejection) {
+	count, ok := d.dryRunDrops.Load(r.Reason)
+	if !ok {
+		count, _ = d.dryRunDrops.LoadOrStore(r.Reason, new(int64))
+	}
+	atomic.AddInt64(count.(*int64), 1)
+	if debug {
+		logger("[Dry run] %s would have dropped a request to %s: %s, B, U %d, %d, B*, U* %d, %d", d.nodeName, method, r.Reason, r.B, r.U, r.Bstar, r.Ustar)
+	}
+	if d.onDryRunDrop != nil {
+		d.onDryRunDrop(DryRunDrop{Method: method, Rejection: r})
+	}
+}
+
+// DryRunDrops returns the number of requests the dry-run mode admitted although DAGOR would have dropped
+// them, by rejection reason.
+func (d *Dagor) DryRunDrops() map[string]int64 {
+	drops := make(map[string]int64)
+	d.dryRunDrops.Range(func(key, value interface{}) bool {
+		drops[key.(string)] = atomic.LoadInt64(value.(*int64))
+		return true
+	})
+	return drops
+}
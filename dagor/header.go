@@ -0,0 +1,164 @@
+package dagor
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+)
+
+// Version of the binary DAGOR headers. Decoders accept later versions as long as they start with the
+// fields of the versions they know, so that fields can be appended without breaking older nodes.
+const protocolVersion = 1
+
+const (
+	priorityHeaderLen = 14 // version, B, U, hops, user hash
+	levelHeaderLen    = 5  // version, B*, U*
+)
+
+// DefaultMetadataPrefix is the default prefix of the binary DAGOR metadata keys.
+const DefaultMetadataPrefix = "dagor"
+
+// Legacy text metadata keys, still accepted while deployments migrate to the binary headers.
+const (
+	legacyBKey     = "b"
+	legacyUKey     = "u"
+	legacyBstarKey = "b-star"
+	legacyUstarKey = "u-star"
+)
+
+// Priority is the DAGOR priority of a request, carried downstream in the <prefix>-bin header.
+type Priority struct {
+	B        int
+	U        int
+	UserHash uint64 // Hash of the user ID the entry service assigned U for
+	Hops     int    // Number of DAGOR hops since the entry service
+}
+
+// encodePriority encodes p as the value of the <prefix>-bin header:
+// version (1 byte), B (2 bytes), U (2 bytes), hops (1 byte) and user hash (8 bytes), big-endian.
+func encodePriority(p Priority) string {
+	var buf [priorityHeaderLen]byte
+	buf[0] = protocolVersion
+	binary.BigEndian.PutUint16(buf[1:], uint16(p.B))
+	binary.BigEndian.PutUint16(buf[3:], uint16(p.U))
+	hops := p.Hops
+	if hops > 0xff {
+		hops = 0xff
+	}
+	buf[5] = byte(hops)
+	binary.BigEndian.PutUint64(buf[6:], p.UserHash)
+	return string(buf[:])
+}
+
+// decodePriority decodes the value of the <prefix>-bin header without allocating.
+func decodePriority(v string) (Priority, bool) {
+	if len(v) < priorityHeaderLen || v[0] < protocolVersion {
+		return Priority{}, false
+	}
+	return Priority{
+		B:        int(v[1])<<8 | int(v[2]),
+		U:        int(v[3])<<8 | int(v[4]),
+		Hops:     int(v[5]),
+		UserHash: uint64BE(v[6:]),
+	}, true
+}
+
+// encodeLevel encodes an admission level as the value of the <prefix>-star-bin header:
+// version (1 byte), B* (2 bytes) and U* (2 bytes), big-endian.
+func encodeLevel(Bstar, Ustar int) string {
+	var buf [levelHeaderLen]byte
+	buf[0] = protocolVersion
+	binary.BigEndian.PutUint16(buf[1:], uint16(Bstar))
+	binary.BigEndian.PutUint16(buf[3:], uint16(Ustar))
+	return string(buf[:])
+}
+
+// decodeLevel decodes the value of the <prefix>-star-bin header without allocating.
+func decodeLevel(v string) (int, int, bool) {
+	if len(v) < levelHeaderLen || v[0] < protocolVersion {
+		return 0, 0, false
+	}
+	return int(v[1])<<8 | int(v[2]), int(v[3])<<8 | int(v[4]), true
+}
+
+func uint64BE(v string) uint64 {
+	var n uint64
+	for i := 0; i < 8; i++ {
+		n = n<<8 | uint64(v[i])
+	}
+	return n
+}
+
+// hashUserID hashes a user ID for the priority header.
+func hashUserID(userID string) uint64 {
+	return hashString(userID)
+}
+
+// hashString hashes s with 64-bit FNV-1a, inlined to avoid allocating a hash.Hash.
+func hashString(s string) uint64 {
+	const (
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+	)
+	h := uint64(offset64)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= prime64
+	}
+	return h
+}
+
+type priorityKey struct{}
+
+// priorityCtx carries the priority of the request being served, so that the client interceptor propagates it
+// to the sub-requests. It holds the priority inline, where context.WithValue would allocate once more to box it,
+// and the <prefix>-bin value of the sub-requests, encoded once for all of them.
+type priorityCtx struct {
+	context.Context
+	p     Priority
+	level *admissionLevel // Admission level TapHandle admitted the request under, nil if it did not take the decision
+
+	forwardOnce sync.Once
+	forwarded   string // Value of the <prefix>-bin header of the sub-requests, one hop further
+}
+
+func (c *priorityCtx) Value(key interface{}) interface{} {
+	if key == (priorityKey{}) {
+		return c
+	}
+	return c.Context.Value(key)
+}
+
+// forwardedPriority returns the encoded priority of the sub-requests, one hop further from the entry service.
+func (c *priorityCtx) forwardedPriority() string {
+	c.forwardOnce.Do(c.encodeForwarded)
+	return c.forwarded
+}
+
+func (c *priorityCtx) encodeForwarded() {
+	p := c.p
+	p.Hops++
+	c.forwarded = encodePriority(p)
+}
+
+// withPriority attaches the priority of the request being served to ctx, so that the client
+// interceptor propagates it to the sub-requests.
+func withPriority(ctx context.Context, p Priority) context.Context {
+	return &priorityCtx{Context: ctx, p: p}
+}
+
+// priorityFrom returns the priority context of the request being served, if any.
+func priorityFrom(ctx context.Context) (*priorityCtx, bool) {
+	c, ok := ctx.Value(priorityKey{}).(*priorityCtx)
+	return c, ok
+}
+
+// PriorityFromContext returns the priority that the DAGOR server interceptor assigned to or
+// received with the request being served.
+func PriorityFromContext(ctx context.Context) (Priority, bool) {
+	c, ok := priorityFrom(ctx)
+	if !ok {
+		return Priority{}, false
+	}
+	return c.p, true
+}
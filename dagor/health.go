@@ -0,0 +1,57 @@
+package dagor
+
+import (
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// defaultHealthFloorWindows is the number of consecutive windows at the floor admission level (1, 1)
+// after which the health server reports NOT_SERVING, if HealthFloorWindows is not set.
+const defaultHealthFloorWindows = 3
+
+// HealthStatusSetter is implemented by *health.Server of google.golang.org/grpc/health.
+type HealthStatusSetter interface {
+	SetServingStatus(service string, servingStatus healthpb.HealthCheckResponse_ServingStatus)
+}
+
+// updateHealth reports the service as NOT_SERVING once the admission level has been at the floor (1, 1)
+// for healthFloorWindows consecutive windows, and as SERVING again as soon as it leaves the floor, so that
+// load balancers steer new connections away from a node shedding almost everything. In dry-run mode,
+// the transitions are only logged: steering traffic away is an enforcement action too.
+// It is called with windowMu held, once per window.
+func (d *Dagor) updateHealth() {
+	if d.healthServer == nil {
+		return
+	}
+	floorWindows := d.floorWindows.Load()
+	if floorWindows == 0 {
+		if d.healthNotServing {
+			d.healthNotServing = false
+			if d.dryRun {
+				logger("[Health] %s recovered from the floor admission level, would report SERVING in enforcing mode", d.nodeName)
+				return
+			}
+			d.healthServer.SetServingStatus(d.healthService, healthpb.HealthCheckResponse_SERVING)
+			logger("[Health] %s recovered from the floor admission level, reporting SERVING", d.nodeName)
+		}
+		return
+	}
+	if !d.healthNotServing && floorWindows >= int64(d.healthFloorWindows) {
+		d.healthNotServing = true
+		if d.dryRun {
+			logger("[Health] %s at the floor admission level for %d windows, would report NOT_SERVING in enforcing mode", d.nodeName, floorWindows)
+			return
+		}
+		d.healthServer.SetServingStatus(d.healthService, healthpb.HealthCheckResponse_NOT_SERVING)
+		logger("[Health] %s at the floor admission level for %d windows, reporting NOT_SERVING", d.nodeName, floorWindows)
+	}
+}
+
+// countFloorWindows tracks for how many consecutive windows the admission level has been at the floor (1, 1),
+// for the health server and Listener. It is called with windowMu held, once per window.
+func (d *Dagor) countFloorWindows(Bstar, Ustar int) {
+	if Bstar > 1 || Ustar > 1 {
+		d.floorWindows.Store(0)
+		return
+	}
+	d.floorWindows.Add(1)
+}
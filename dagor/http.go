@@ -0,0 +1,251 @@
+package dagor
+
+import (
+	"context"
+	"encoding/base64"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// HTTPRoute assigns the business priority B to the HTTP requests it matches at an entry service.
+type HTTPRoute struct {
+	Method string // HTTP method, "" matches any
+	Path   string // Exact path, or path prefix if it ends with "/"
+	B      int    // Business priority of the matching requests, Bmax if outside [1, Bmax]
+}
+
+func (route HTTPRoute) matches(r *http.Request) bool {
+	if route.Method != "" && route.Method != r.Method {
+		return false
+	}
+	if strings.HasSuffix(route.Path, "/") {
+		return strings.HasPrefix(r.URL.Path, route.Path)
+	}
+	return r.URL.Path == route.Path
+}
+
+// HTTPMiddleware is the net/http equivalent of UnaryInterceptorServer, sharing the admission level and the
+// histograms of the node with its gRPC traffic. Requests are accounted under the method and path of the first
+// matching HTTP route, else under HTTPMethodKey. Entry services assign B from the HTTP routes, else from the
+// business map keyed by the same method name, other nodes read the priority from the request headers.
+// The DAGOR headers are the metadata keys, binary values base64-encoded as gRPC sends them over HTTP/2.
+// Dropped requests get HTTPRejectStatus (429 by default) with Retry-After and the B* and U* header.
+func (d *Dagor) HTTPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d.bypassed(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		methodName, route := d.httpMethodName(r)
+		ctx, trusted := d.enforceTrustBoundary(d.httpContext(r))
+		if d.entryService && d.trustBoundary && !trusted {
+			r = d.stripDagorHeaders(r)
+		}
+
+		var p Priority
+		var err error
+		if d.entryService && !(trusted && d.hasIncomingPriority(ctx)) {
+			var B int
+			if B, err = d.httpBusiness(ctx, route, methodName); err == nil {
+				p, err = d.assignPriority(ctx, methodName, B)
+			}
+		} else {
+			p, err = d.incomingPriority(ctx, methodName, signedHTTPMethod(r))
+		}
+		if err != nil {
+			http.Error(w, status.Convert(err).Message(), httpStatusFromCode(status.Code(err)))
+			return
+		}
+		if d.entryService && d.echoPriority {
+			w.Header().Set(d.priorityKey, encodeBinHeader(encodePriority(p)))
+		}
+		ctx = withPriority(ctx, p)
+		if d.entryService && d.sendLegacyMetadata {
+			ctx = metadata.AppendToOutgoingContext(ctx, legacyBKey, strconv.Itoa(p.B), legacyUKey, strconv.Itoa(p.U))
+		}
+
+		level, err := d.admit(methodName, p.B, p.U)
+		d.setHTTPLevelHeaders(w.Header(), level)
+		if err != nil {
+			retryAfter := int(math.Ceil(d.admissionLevelUpdateInterval.Seconds()))
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			http.Error(w, msgServerReject, d.httpRejectStatus)
+			return
+		}
+		if err := d.acquireSlot(ctx, p.B, p.U); err != nil {
+			http.Error(w, status.Convert(err).Message(), http.StatusServiceUnavailable)
+			return
+		}
+		defer d.releaseSlot()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// signedHTTPMethod returns the "METHOD /path" of an HTTP request, which its priority signature is bound to.
+func signedHTTPMethod(r *http.Request) string {
+	return r.Method + " " + r.URL.Path
+}
+
+// stripDagorHeaders returns r without the DAGOR headers of an untrusted caller, which the handler could
+// otherwise forward to its sub-requests, e.g. in a gateway. The request is cloned only if it has some.
+func (d *Dagor) stripDagorHeaders(r *http.Request) *http.Request {
+	stripped := r
+	for _, key := range d.dagorMetadataKeys() {
+		if _, ok := r.Header[http.CanonicalHeaderKey(key)]; !ok {
+			continue
+		}
+		if stripped == r {
+			stripped = r.Clone(r.Context())
+		}
+		stripped.Header.Del(key)
+	}
+	return stripped
+}
+
+// httpMethodName returns the method name an HTTP request is classified and accounted under, and the first route
+// matching it if any: "METHOD /path" of the route, else the key of httpMethodKey, so that paths with IDs
+// do not each become a method of their own.
+func (d *Dagor) httpMethodName(r *http.Request) (string, *HTTPRoute) {
+	for i := range d.httpRoutes {
+		route := &d.httpRoutes[i]
+		if route.matches(r) {
+			method := route.Method
+			if method == "" {
+				method = r.Method
+			}
+			return method + " " + route.Path, route
+		}
+	}
+	return d.httpMethodKey(r), nil
+}
+
+// defaultHTTPMethodKey keys an HTTP request by its method and its path, with the segments that look like IDs
+// replaced by {id}.
+func defaultHTTPMethodKey(r *http.Request) string {
+	return r.Method + " " + routePath(r.URL.Path)
+}
+
+// routePath replaces the segments of path that look like IDs, numbers, UUIDs and long hexadecimal strings, by {id}.
+func routePath(path string) string {
+	segments := strings.Split(path, "/")
+	changed := false
+	for i, segment := range segments {
+		if isIDSegment(segment) {
+			segments[i] = "{id}"
+			changed = true
+		}
+	}
+	if !changed {
+		return path
+	}
+	return strings.Join(segments, "/")
+}
+
+// isIDSegment tells whether a path segment is a number, or a hexadecimal string of 16 characters or more, dashes
+// included as in UUIDs.
+func isIDSegment(segment string) bool {
+	if segment == "" {
+		return false
+	}
+	digits := true
+	for i := 0; i < len(segment); i++ {
+		switch c := segment[i]; {
+		case c >= '0' && c <= '9':
+		case c >= 'a' && c <= 'f', c >= 'A' && c <= 'F', c == '-':
+			digits = false
+		default:
+			return false
+		}
+	}
+	return digits || len(segment) >= 16
+}
+
+// httpBusiness returns the B of an HTTP request at an entry service: the hint of the end user if accepted,
+// else the one of the route it matches, else the one of the business map or the unknown method policy.
+func (d *Dagor) httpBusiness(ctx context.Context, route *HTTPRoute, methodName string) (int, error) {
+	if _, ok := d.hintedBusiness(ctx); !ok && route != nil {
+		return route.B, nil
+	}
+	return d.business(ctx, methodName)
+}
+
+// httpContext exposes the headers of an HTTP request as incoming metadata and its client as the peer, so that
+// the priority, user ID and trust checks of the gRPC path apply unchanged.
+func (d *Dagor) httpContext(r *http.Request) context.Context {
+	ctx := metadata.NewIncomingContext(r.Context(), httpMetadata(r.Header))
+	p := &peer.Peer{Addr: httpAddr(r.RemoteAddr)}
+	if r.TLS != nil {
+		p.AuthInfo = credentials.TLSInfo{State: *r.TLS}
+	}
+	return peer.NewContext(ctx, p)
+}
+
+// httpMetadata converts HTTP headers to metadata, decoding the binary values.
+func httpMetadata(h http.Header) metadata.MD {
+	md := make(metadata.MD, len(h))
+	for k, vs := range h {
+		key := strings.ToLower(k)
+		if !strings.HasSuffix(key, "-bin") {
+			md[key] = vs
+			continue
+		}
+		for _, v := range vs {
+			if b, err := decodeBinHeader(v); err == nil {
+				md[key] = append(md[key], string(b))
+			}
+		}
+	}
+	return md
+}
+
+// setHTTPLevelHeaders sets the B* and U* headers of a response, binary and, if enabled, legacy.
+func (d *Dagor) setHTTPLevelHeaders(h http.Header, level *admissionLevel) {
+	h.Set(d.levelKey, encodeBinHeader(encodeLevel(level.Bstar, level.Ustar)))
+	if d.sendLegacyMetadata {
+		h.Set(legacyBstarKey, strconv.Itoa(level.Bstar))
+		h.Set(legacyUstarKey, strconv.Itoa(level.Ustar))
+	}
+}
+
+// httpStatusFromCode maps the gRPC codes of the DAGOR errors to HTTP statuses.
+func httpStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+// encodeBinHeader encodes a binary header value for HTTP, as gRPC does.
+func encodeBinHeader(v string) string {
+	return base64.RawStdEncoding.EncodeToString([]byte(v))
+}
+
+// decodeBinHeader decodes a binary header value, padded or not.
+func decodeBinHeader(v string) ([]byte, error) {
+	if len(v)%4 == 0 {
+		return base64.StdEncoding.DecodeString(v)
+	}
+	return base64.RawStdEncoding.DecodeString(v)
+}
+
+// httpAddr is the remote address of an HTTP request, as a net.Addr for the peer checks.
+type httpAddr string
+
+func (a httpAddr) Network() string { return "tcp" }
+func (a httpAddr) String() string  { return string(a) }
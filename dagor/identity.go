@@ -0,0 +1,125 @@
+package dagor
+
+import (
+	"context"
+	"net"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// UserIDKey is the metadata key end users send their user ID in, and the default source of the user ID
+// at entry services.
+const UserIDKey = "user-id"
+
+// UserIDExtractor returns the ID of the user a request is sent for, which the entry service assigns U to.
+type UserIDExtractor func(ctx context.Context) (string, bool)
+
+// UserIDFallback tells an entry service what to do with a request whose user ID cannot be extracted.
+type UserIDFallback int
+
+const (
+	// UserIDReject rejects the request with InvalidArgument.
+	UserIDReject UserIDFallback = iota
+	// UserIDLowestPriority serves the request with the lowest user priority, Umax.
+	UserIDLowestPriority
+	// UserIDRandomPriority serves the request with a random user priority, drawn per request.
+	UserIDRandomPriority
+)
+
+// UserIDFromMetadata extracts the user ID from the last value of a metadata key, e.g. one set by an
+// authenticating proxy from a JWT subject or a session cookie. A proxy appending its value after one sent
+// by the client takes precedence over it.
+func UserIDFromMetadata(key string) UserIDExtractor {
+	return func(ctx context.Context) (string, bool) {
+		return lastIncomingValue(ctx, key)
+	}
+}
+
+// UserIDFromPeerAddress uses the IP address of the caller as user ID, for anonymous calls.
+func UserIDFromPeerAddress(ctx context.Context) (string, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return "", false
+	}
+	addr := p.Addr.String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host, true
+	}
+	return addr, addr != ""
+}
+
+// UserIDFromTLSIdentity uses the identity of the TLS client certificate as user ID: its first URI SAN,
+// else its first DNS SAN, else its common name.
+func UserIDFromTLSIdentity(ctx context.Context) (string, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.PeerCertificates) == 0 {
+		return "", false
+	}
+	cert := info.State.PeerCertificates[0]
+	switch {
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String(), true
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0], true
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName, true
+	}
+	return "", false
+}
+
+// FirstUserID tries the extractors in order and returns the first user ID found.
+func FirstUserID(extractors ...UserIDExtractor) UserIDExtractor {
+	return func(ctx context.Context) (string, bool) {
+		for _, extract := range extractors {
+			if userID, ok := extract(ctx); ok {
+				return userID, true
+			}
+		}
+		return "", false
+	}
+}
+
+// userPriorityFor returns the U of the user the request is sent for, assigning a random one to new users,
+// and the hash of the user ID carried in the priority header.
+func (d *Dagor) userPriorityFor(ctx context.Context, methodName string) (int, uint64, error) {
+	userID, ok := d.userIDExtractor(ctx)
+	if !ok {
+		switch d.userIDFallback {
+		case UserIDLowestPriority:
+			if debug {
+				logger("[Entry service] %s found no user ID, assigned the lowest priority %d", d.nodeName, d.Umax)
+			}
+			return d.Umax, 0, nil
+		case UserIDRandomPriority:
+			U := d.randIntn(d.Umax) + 1
+			if debug {
+				logger("[Entry service] %s found no user ID, assigned a random priority %d", d.nodeName, U)
+			}
+			return U, 0, nil
+		}
+		if d.dryRun {
+			// serve the request as UserIDLowestPriority would
+			d.recordDryRunPolicyDrop(methodName, ReasonNoUserID)
+			return d.Umax, 0, nil
+		}
+		return 0, 0, errNoUserID
+	}
+	var U int
+	if val, ok := d.userPriority.Load(userID); ok {
+		U = val.(int)
+		if debug {
+			logger("[Entry service] User %s already has a priority value assigned: %d", userID, U)
+		}
+	} else {
+		// Assign a random int for U between 1 and Umax
+		U = d.randIntn(d.Umax) + 1
+		d.userPriority.Store(userID, U)
+		logger("User %s assigned a priority value: %d", userID, U)
+	}
+	return U, hashUserID(userID), nil
+}
@@ -0,0 +1,101 @@
+package dagor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/tap"
+)
+
+const benchMethod = "/bench.Service/Method"
+
+// benchStream stands in for the transport stream gRPC attaches to the context of server handlers.
+type benchStream struct{}
+
+func (benchStream) Method() string                  { return benchMethod }
+func (benchStream) SetHeader(md metadata.MD) error  { return nil }
+func (benchStream) SendHeader(md metadata.MD) error { return nil }
+func (benchStream) SetTrailer(md metadata.MD) error { return nil }
+
+func newBenchNode() *Dagor {
+	return NewDagorNode(DagorParam{NodeName: "bench", Bmax: 4, Umax: 8, AdmissionLevelUpdateInterval: time.Second, ManualUpdate: true})
+}
+
+// serverCall returns a call running a request with priority (2, 2) through UnaryInterceptorServer of a node with
+// admission level (Bstar, Ustar).
+func serverCall(Bstar, Ustar int) func() {
+	d := newBenchNode()
+	d.admissionLevel.Store(d.newAdmissionLevel(Bstar, Ustar))
+	ctx := grpc.NewContextWithServerTransportStream(context.Background(), benchStream{})
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(d.priorityKey, encodePriority(Priority{B: 2, U: 2})))
+	info := &grpc.UnaryServerInfo{FullMethod: benchMethod}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return req, nil }
+	return func() { d.UnaryInterceptorServer(ctx, nil, info, handler) }
+}
+
+// tappedServerCall returns a call running a request with priority (2, 2), admitted by TapHandle under the
+// admission level (4, 8), through UnaryInterceptorServer.
+func tappedServerCall() func() {
+	d := newBenchNode()
+	d.admissionLevel.Store(d.newAdmissionLevel(4, 8))
+	header := metadata.Pairs(d.priorityKey, encodePriority(Priority{B: 2, U: 2}))
+	// gRPC adds the incoming metadata to the context before calling TapHandle
+	ctx := metadata.NewIncomingContext(grpc.NewContextWithServerTransportStream(context.Background(), benchStream{}), header)
+	ctx, _ = d.TapHandle(ctx, &tap.Info{FullMethodName: benchMethod, Header: header})
+	info := &grpc.UnaryServerInfo{FullMethod: benchMethod}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return req, nil }
+	return func() { d.UnaryInterceptorServer(ctx, nil, info, handler) }
+}
+
+// clientCall returns a call sending a sub-request with priority (2, 2) through UnaryInterceptorClient of a node
+// that learned the threshold (Bstar, Ustar) from the downstream.
+func clientCall(Bstar, Ustar int) func() {
+	d := newBenchNode()
+	d.StoreThreshold(benchMethod, Bstar, Ustar)
+	ctx := withPriority(context.Background(), Priority{B: 2, U: 2})
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		return nil
+	}
+	return func() { d.UnaryInterceptorClient(ctx, benchMethod, nil, nil, nil, invoker) }
+}
+
+func benchmarkCall(b *testing.B, call func()) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		call()
+	}
+}
+
+func BenchmarkServerAdmit(b *testing.B) { benchmarkCall(b, serverCall(4, 8)) }
+
+func BenchmarkServerDrop(b *testing.B) { benchmarkCall(b, serverCall(1, 1)) }
+
+func BenchmarkClientAdmit(b *testing.B) { benchmarkCall(b, clientCall(4, 8)) }
+
+func BenchmarkClientDrop(b *testing.B) { benchmarkCall(b, clientCall(1, 1)) }
+
+// BenchmarkAdmitDecision measures the server admission decision alone, admitting and dropping in turn.
+func BenchmarkAdmitDecision(b *testing.B) {
+	d := newBenchNode()
+	d.admissionLevel.Store(d.newAdmissionLevel(2, 2))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.admit(benchMethod, 2, 1+i&3)
+	}
+}
+
+// BenchmarkLocalRejectDecision measures the client admission decision alone, admitting and dropping in turn.
+func BenchmarkLocalRejectDecision(b *testing.B) {
+	d := newBenchNode()
+	d.StoreThreshold(benchMethod, 2, 2)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.localReject(benchMethod, 2, 1+i&3)
+	}
+}
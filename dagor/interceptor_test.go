@@ -0,0 +1,44 @@
+package dagor
+
+import (
+	"testing"
+)
+
+// The allocations left on the admit and drop paths are those of the gRPC metadata API: ValueFromIncomingContext
+// copies the values it returns, and AppendToOutgoingContext allocates four times to add the priority of a
+// sub-request. The server interceptor allocates once more for the context passing the priority to the handler,
+// unless TapHandle admitted the request.
+func TestInterceptorAllocs(t *testing.T) {
+	tests := []struct {
+		name string
+		call func()
+		max  float64
+	}{
+		{"ServerAdmit", serverCall(4, 8), 2},
+		{"ServerDrop", serverCall(1, 1), 1},
+		{"ServerTapped", tappedServerCall(), 0},
+		{"ClientAdmit", clientCall(4, 8), 4},
+		{"ClientDrop", clientCall(1, 1), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if allocs := testing.AllocsPerRun(100, tt.call); allocs > tt.max {
+				t.Errorf("%s allocates %v times per call, want at most %v", tt.name, allocs, tt.max)
+			}
+		})
+	}
+}
+
+func TestDecisionAllocs(t *testing.T) {
+	d := newBenchNode()
+	d.admissionLevel.Store(d.newAdmissionLevel(2, 2))
+	d.StoreThreshold(benchMethod, 2, 2)
+	for U := 1; U <= 4; U++ {
+		if allocs := testing.AllocsPerRun(100, func() { d.admit(benchMethod, 2, U) }); allocs != 0 {
+			t.Errorf("admit(2, %d) allocates %v times, want 0", U, allocs)
+		}
+		if allocs := testing.AllocsPerRun(100, func() { d.localReject(benchMethod, 2, U) }); allocs != 0 {
+			t.Errorf("localReject(2, %d) allocates %v times, want 0", U, allocs)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package dagor
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+)
+
+// defaultConnectionFloorWindows is the number of consecutive windows at the floor admission level (1, 1)
+// after which Listener sheds new connections, if ConnectionFloorWindows is not set.
+const defaultConnectionFloorWindows = 3
+
+// ConnectionPolicy tells Listener what to do with new connections while the node is in deep overload.
+type ConnectionPolicy int
+
+const (
+	// DelayConnections holds each new connection for ConnectionDelay before handing it to the server,
+	// which also holds back accepting the next ones.
+	DelayConnections ConnectionPolicy = iota
+	// RefuseConnections closes new connections as soon as they are accepted.
+	RefuseConnections
+)
+
+// ConnectionStats counts the new connections seen by the listeners wrapped by Listener.
+type ConnectionStats struct {
+	Accepted int64 // Connections handed to the server, delayed ones included
+	Delayed  int64 // Connections held for ConnectionDelay
+	Refused  int64 // Connections closed right after being accepted
+}
+
+type connectionCounters struct {
+	accepted atomic.Int64
+	delayed  atomic.Int64
+	refused  atomic.Int64
+}
+
+// ConnectionStats returns the connection counts of the listeners wrapped by Listener since the node started.
+func (d *Dagor) ConnectionStats() ConnectionStats {
+	return ConnectionStats{
+		Accepted: d.connections.accepted.Load(),
+		Delayed:  d.connections.delayed.Load(),
+		Refused:  d.connections.refused.Load(),
+	}
+}
+
+// Listener wraps a server listener to shed new connections, and the TLS handshakes and stream setups
+// that come with them, while the admission level has been at the floor (1, 1) for ConnectionFloorWindows
+// consecutive windows. New connections are then delayed or refused according to ConnectionPolicy, the
+// established ones keep being served. In dry-run mode, the connections are counted but handed over at once.
+func (d *Dagor) Listener(l net.Listener) net.Listener {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &admissionListener{Listener: l, d: d, ctx: ctx, cancel: cancel}
+}
+
+type admissionListener struct {
+	net.Listener
+	d      *Dagor
+	ctx    context.Context // Canceled by Close, to stop waiting on a delayed connection
+	cancel context.CancelFunc
+}
+
+func (l *admissionListener) Accept() (net.Conn, error) {
+	d := l.d
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if !d.deepOverload() {
+			d.connections.accepted.Add(1)
+			return conn, nil
+		}
+		if d.connectionPolicy == RefuseConnections {
+			d.connections.refused.Add(1)
+			if d.dryRun {
+				d.connections.accepted.Add(1)
+				return conn, nil
+			}
+			if debug {
+				logger("[Listener] %s in deep overload, refused a connection from %v", d.nodeName, conn.RemoteAddr())
+			}
+			conn.Close()
+			continue
+		}
+		d.connections.delayed.Add(1)
+		if !d.dryRun {
+			if debug {
+				logger("[Listener] %s in deep overload, delaying a connection from %v by %v", d.nodeName, conn.RemoteAddr(), d.connectionDelay)
+			}
+			if d.sleep(l.ctx, d.connectionDelay) != nil {
+				conn.Close()
+				return nil, net.ErrClosed
+			}
+		}
+		d.connections.accepted.Add(1)
+		return conn, nil
+	}
+}
+
+func (l *admissionListener) Close() error {
+	l.cancel()
+	return l.Listener.Close()
+}
+
+// deepOverload tells whether the admission level has been at the floor long enough to shed new connections.
+func (d *Dagor) deepOverload() bool {
+	return d.floorWindows.Load() >= int64(d.connectionFloorWindows)
+}
@@ -0,0 +1,72 @@
+package dagor
+
+import (
+	"context"
+	"time"
+)
+
+// LoadReport is the DAGOR state of the last admission control window, published to the LoadReporter.
+type LoadReport struct {
+	QueuingDelay   time.Duration // Queuing delay of the window
+	Utilization    float64       // Queuing delay relative to QueuingThresh, 0 if QueuingThresh is not set
+	AdmissionLevel float64       // Admission level normalized to [0, 1], 1 admits every priority
+	ShedRatio      float64       // Fraction of the requests dropped in the window
+}
+
+// LoadReporter publishes the load of a node, e.g. to ORCA with the orcareport package, so that
+// load balancers can steer traffic away from overloaded backends.
+type LoadReporter interface {
+	// ReportLoad is called by AdjustAdmissionLevel at the end of every window.
+	ReportLoad(report LoadReport)
+	// ReportCallLoad is called by the server interceptor for every request it decides, with the report of
+	// the last window.
+	ReportCallLoad(ctx context.Context, report LoadReport)
+}
+
+// normalizedLevel maps the admission level (B*, U*) to [0, 1] in priority order, from 0 at (1, 1)
+// to 1 at (Bmax, Umax).
+func (d *Dagor) normalizedLevel(Bstar, Ustar int) float64 {
+	levels := d.Bmax*d.Umax - 1
+	if levels <= 0 {
+		return 1
+	}
+	return float64((Bstar-1)*d.Umax+Ustar-1) / float64(levels)
+}
+
+// reportLoad publishes the state of the window that just ended, for the per-call reports, and hands it
+// to the load reporter if one is configured.
+func (d *Dagor) reportLoad(queuingDelay time.Duration, Bstar, Ustar int, snap CounterSnapshot) {
+	report := &LoadReport{
+		QueuingDelay:   queuingDelay,
+		AdmissionLevel: d.normalizedLevel(Bstar, Ustar),
+	}
+	if d.queuingThresh > 0 {
+		report.Utilization = float64(queuingDelay) / float64(d.queuingThresh)
+	}
+	if snap.N > 0 {
+		report.ShedRatio = 1 - float64(snap.Nadm)/float64(snap.N)
+	}
+	d.loadReport.Store(report)
+	if d.loadReporter != nil {
+		d.loadReporter.ReportLoad(*report)
+	}
+}
+
+// reportCallLoad hands the report of the last window to the load reporter for the request of ctx.
+func (d *Dagor) reportCallLoad(ctx context.Context) {
+	if d.loadReporter == nil {
+		return
+	}
+	if report := d.loadReport.Load(); report != nil {
+		d.loadReporter.ReportCallLoad(ctx, *report)
+	}
+}
+
+// LoadReport returns the state of the last admission control window, false before the first window ends.
+func (d *Dagor) LoadReport() (LoadReport, bool) {
+	report := d.loadReport.Load()
+	if report == nil {
+		return LoadReport{}, false
+	}
+	return *report, true
+}
@@ -2,7 +2,10 @@ package dagor
 
 import (
 	"math/rand"
+	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -20,26 +23,76 @@ type Dagor struct {
 	thresholdTable sync.Map       // Concurrent map to keep B* and U* values for each downstream, key is method name
 	// userPriority   map[string]int          // Map from user to priority
 	// thresholdTable map[string]thresholdVal // Map to keep B* and U* values for each downstream, key is method name
-	entryService                 bool     // Entry service for the DAGOR network
-	isEnduser                    bool     // Is this node an end user?
-	admissionLevel               sync.Map // Map to keep track of admission level B and U
+	entryService                 bool                           // Entry service for the DAGOR network
+	isEnduser                    bool                           // Is this node an end user?
+	admissionLevel               atomic.Pointer[admissionLevel] // Admission level (B*, U*), both are published at once
 	admissionLevelUpdateInterval time.Duration
 	alpha                        float64
 	beta                         float64
 	Umax                         int
 	Bmax                         int
-	C                            sync.Map
-	N                            int64 // Use int64 to be compatible with atomic operations
-	Nadm                         int64 // Use int64 to be compatible with atomic operations
 	UseSyncMap                   bool
-	CM                           *CounterMatrix
-	// C is a two-dimensional array or a map that corresponds to the counters for each B, U pair.
-	// You need to initialize this with the actual data structure you are using.
+	UseShardedCounters           bool
+	window                       atomic.Pointer[counterWindow] // Counters N, Nadm and C of the current window
+	spare                        *counterWindow                // Cleared window swapped in at the next update, guarded by windowMu
+	windowMu                     sync.Mutex                    // Serializes the window rotations
+	priorityKey                  string                        // Binary priority header, <prefix>-bin
+	levelKey                     string                        // Binary admission level response header, <prefix>-star-bin
+	sendLegacyMetadata           bool                          // Also send the legacy b, u, b-star and u-star keys
+	signatureKey                 string                        // Priority signature header, <prefix>-sig-bin
+	businessKey                  string                        // Business priority hint of end users, <prefix>-business
+	acceptBusinessHints          bool
+	signingKeys                  map[string][]byte
+	signingKeyID                 string
+	signaturePolicy              SignaturePolicy
+	signatureTTL                 time.Duration
+	trustBoundary                bool      // Strip the DAGOR metadata of untrusted callers at the entry service
+	trustedPeer                  PeerTrust // Callers whose priorities the entry service passes through
+	unknownMethodPolicy          UnknownMethodPolicy
+	defaultBusiness              int
+	userIDExtractor              UserIDExtractor
+	userIDFallback               UserIDFallback
+	echoPriority                 bool // Entry service echoes the assigned priority to end users
+	preThrottle                  bool // End user drops calls locally while the entry sheds their priority
+	probeInterval                time.Duration
+	entryLevels                  sync.Map     // Concurrent map from entryLevelKey to *entryLevel, for pre-throttling
+	entryLevelCount              atomic.Int64 // Number of entries in entryLevels, evicted beyond maxEntryLevels
+	entryLevelsEvicting          sync.Mutex   // Held while evicting from entryLevels
+	retryPolicy                  RetryPolicy
+	retryBudget                  retryBudget
+	dryRun                       bool // Admit every request, only record the would-be drops
+	onDryRunDrop                 func(DryRunDrop)
+	dryRunDrops                  sync.Map // Concurrent map from rejection reason to *int64
+	bypassMethods                map[string]bool
+	bypassPrefixes               []string
+	healthServer                 HealthStatusSetter
+	healthService                string
+	healthFloorWindows           int
+	floorWindows                 atomic.Int64 // Consecutive windows at the floor admission level, written with windowMu held
+	healthNotServing             bool         // guarded by windowMu
+	connectionPolicy             ConnectionPolicy
+	connectionFloorWindows       int
+	connectionDelay              time.Duration
+	connections                  connectionCounters
+	scheduler                    *scheduler // Priority queue of the admitted requests, nil without MaxConcurrency
+	loadReporter                 LoadReporter
+	loadReport                   atomic.Pointer[LoadReport] // DAGOR state of the last window, for the per-call reports
+	httpRoutes                   []HTTPRoute
+	httpRejectStatus             int
+	httpRouteKey                 HTTPRouteKeyFunc
+	httpMethodKey                HTTPRouteKeyFunc
+	unclassifiedMethods          sync.Map     // Concurrent map from methods missing from businessMap to *unclassifiedMethod
+	unclassifiedCount            atomic.Int64 // Number of methods in unclassifiedMethods, at most maxUnclassifiedMethods
+	unclassifiedOverflow         atomic.Int64 // Requests to methods not tracked in unclassifiedMethods
+	clock                        Clock        // Time source for the admission level updates
+	rng                          *rand.Rand   // Random source for priority assignment, guarded by rngMu
+	rngMu                        sync.Mutex
 }
 
 type thresholdVal struct {
-	Bstar int
-	Ustar int
+	Bstar      int
+	Ustar      int
+	rejections *rejections // Errors of the sub-requests dropped under this threshold
 }
 
 type DagorParam struct {
@@ -55,6 +108,43 @@ type DagorParam struct {
 	Bmax                         int
 	Debug                        bool
 	UseSyncMap                   bool
+	UseShardedCounters           bool                // Spread the counters over per-P shards, takes precedence over UseSyncMap
+	Clock                        Clock               // Optional, defaults to the real clock
+	RandSource                   rand.Source         // Optional, defaults to a source seeded with the current time
+	ManualUpdate                 bool                // Do not start UpdateAdmissionLevel, the caller drives AdjustAdmissionLevel
+	MetadataPrefix               string              // Prefix of the binary metadata keys, defaults to DefaultMetadataPrefix
+	SendLegacyMetadata           bool                // Also send the legacy text keys, for downstreams that do not read the binary headers yet
+	SigningKeys                  map[string][]byte   // Shared HMAC keys by key ID, several keys allow rotating them
+	SigningKeyID                 string              // Key the priorities of the sub-requests are signed with, empty to not sign
+	SignaturePolicy              SignaturePolicy     // What to do with priorities that are not signed with one of SigningKeys
+	SignatureTTL                 time.Duration       // How long a signature stays valid, defaults to 30s
+	TrustBoundary                bool                // At the entry service, strip the DAGOR metadata and method override sent by callers not trusted by TrustedPeer, key BusinessMap by full method names
+	TrustedPeer                  PeerTrust           // Internal callers whose priorities the entry service passes through, nil trusts none
+	UnknownMethodPolicy          UnknownMethodPolicy // How the entry service assigns B to methods missing from BusinessMap
+	DefaultBusiness              int                 // B of the methods missing from BusinessMap with UnknownMethodDefault, defaults to Bmax
+	UserIDExtractor              UserIDExtractor     // How the entry service identifies users, defaults to the user-id metadata key
+	UserIDFallback               UserIDFallback      // What the entry service does with requests without a user ID
+	AcceptBusinessHints          bool                // Let end users pick B with WithBusiness, instead of BusinessMap
+	EchoPriority                 bool                // Entry service echoes the assigned B and U to end users, along with B* and U*
+	PreThrottle                  bool                // End user drops calls locally while the entry service sheds their priority, needs EchoPriority at the entry
+	PreThrottleProbeInterval     time.Duration       // Mean interval between probes of a pre-throttling end user, defaults to AdmissionLevelUpdateInterval
+	Retry                        RetryPolicy         // Retries of RetryingUnaryInterceptorClient
+	DryRun                       bool                // Run the admission control and update the histograms, but admit every request
+	OnDryRunDrop                 func(DryRunDrop)    // Optional, called for every request admitted by DryRun that would have been dropped
+	BypassMethods                []string            // Full method names exempt from DAGOR, e.g. /grpc.health.v1.Health/Check
+	BypassPrefixes               []string            // Prefixes of the full method names exempt from DAGOR, e.g. /grpc.reflection.
+	HealthServer                 HealthStatusSetter  // Optional, e.g. a *health.Server, reports NOT_SERVING while the node sheds almost everything
+	HealthService                string              // Service name whose status is set, "" for the whole server
+	HealthFloorWindows           int                 // Consecutive windows at the admission level (1, 1) before NOT_SERVING, defaults to 3
+	LoadReporter                 LoadReporter        // Optional, receives the DAGOR load every window and per call, e.g. an orcareport.Reporter
+	HTTPRoutes                   []HTTPRoute         // Business priorities of the HTTP requests at the entry service, first match wins
+	HTTPRejectStatus             int                 // Status of the HTTP requests dropped by HTTPMiddleware, 429 or 503, defaults to 429
+	HTTPRouteKey                 HTTPRouteKeyFunc    // Threshold table key of the requests sent through RoundTripper, defaults to host and path with IDs replaced by {id}
+	HTTPMethodKey                HTTPRouteKeyFunc    // Method name of the HTTP requests matching no HTTPRoutes, defaults to "METHOD /path" with IDs replaced by {id}
+	ConnectionPolicy             ConnectionPolicy    // What Listener does with new connections while the node is in deep overload
+	ConnectionFloorWindows       int                 // Consecutive windows at the admission level (1, 1) before Listener sheds new connections, defaults to 3
+	ConnectionDelay              time.Duration       // How long DelayConnections holds each new connection, defaults to AdmissionLevelUpdateInterval
+	MaxConcurrency               int                 // Admitted requests running at once, the others wait in a queue ordered by (B, U); 0 runs them all at once
 }
 
 // NewDagorNode creates a new DAGOR node without a UUID.
@@ -68,34 +158,126 @@ func NewDagorNode(params DagorParam) *Dagor {
 		thresholdTable:               sync.Map{}, // Initialize as empty concurrent map
 		entryService:                 params.EntryService,
 		isEnduser:                    params.IsEnduser,
-		admissionLevel:               sync.Map{}, // Initialize as empty concurrent map
 		admissionLevelUpdateInterval: params.AdmissionLevelUpdateInterval,
 		alpha:                        params.Alpha,
 		beta:                         params.Beta,
 		Umax:                         params.Umax,
 		Bmax:                         params.Bmax,
-		UseSyncMap:                   params.UseSyncMap,
-		CM:                           NewCounterMatrix(params.Bmax, params.Umax),
+		UseSyncMap:                   params.UseSyncMap && !params.UseShardedCounters,
+		UseShardedCounters:           params.UseShardedCounters,
+		clock:                        params.Clock,
+		sendLegacyMetadata:           params.SendLegacyMetadata,
+		signingKeys:                  params.SigningKeys,
+		signingKeyID:                 params.SigningKeyID,
+		signaturePolicy:              params.SignaturePolicy,
+		signatureTTL:                 params.SignatureTTL,
+		trustBoundary:                params.TrustBoundary,
+		trustedPeer:                  params.TrustedPeer,
+		unknownMethodPolicy:          params.UnknownMethodPolicy,
+		defaultBusiness:              params.DefaultBusiness,
+		userIDExtractor:              params.UserIDExtractor,
+		userIDFallback:               params.UserIDFallback,
+		acceptBusinessHints:          params.AcceptBusinessHints,
+		echoPriority:                 params.EchoPriority,
+		preThrottle:                  params.PreThrottle,
+		probeInterval:                params.PreThrottleProbeInterval,
+		retryPolicy:                  params.Retry.withDefaults(),
+		dryRun:                       params.DryRun,
+		onDryRunDrop:                 params.OnDryRunDrop,
+		bypassPrefixes:               params.BypassPrefixes,
+		healthServer:                 params.HealthServer,
+		healthService:                params.HealthService,
+		healthFloorWindows:           params.HealthFloorWindows,
+		connectionPolicy:             params.ConnectionPolicy,
+		connectionFloorWindows:       params.ConnectionFloorWindows,
+		connectionDelay:              params.ConnectionDelay,
+		loadReporter:                 params.LoadReporter,
+		httpRejectStatus:             params.HTTPRejectStatus,
+		httpRouteKey:                 params.HTTPRouteKey,
+		httpMethodKey:                params.HTTPMethodKey,
 	}
-	dagor.admissionLevel.Store("B", dagor.Bmax)
-	dagor.admissionLevel.Store("U", dagor.Umax)
-	rand.Seed(time.Now().UnixNano())
-
-	if dagor.UseSyncMap {
-		// Initialize the C matrix with the initial counters for each B, U pair
-		for B := 1; B <= params.Bmax; B++ {
-			for U := 1; U <= params.Umax; U++ {
-				dagor.C.Store([2]int{B, U}, int64(0))
-			}
+	prefix := params.MetadataPrefix
+	if prefix == "" {
+		prefix = DefaultMetadataPrefix
+	}
+	dagor.priorityKey = prefix + "-bin"
+	dagor.levelKey = prefix + "-star-bin"
+	dagor.signatureKey = prefix + "-sig-bin"
+	dagor.businessKey = prefix + "-business"
+	if dagor.userIDExtractor == nil {
+		dagor.userIDExtractor = UserIDFromMetadata(UserIDKey)
+	}
+	dagor.retryBudget.ratio = dagor.retryPolicy.BudgetRatio
+	dagor.retryBudget.burst = dagor.retryPolicy.BudgetBurst
+	dagor.bypassMethods = make(map[string]bool, len(params.BypassMethods))
+	for _, method := range params.BypassMethods {
+		dagor.bypassMethods[method] = true
+	}
+	switch dagor.httpRejectStatus {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+	case 0:
+		dagor.httpRejectStatus = http.StatusTooManyRequests
+	default:
+		logger("HTTP reject status %d is neither 429 nor 503, using 429", dagor.httpRejectStatus)
+		dagor.httpRejectStatus = http.StatusTooManyRequests
+	}
+	if dagor.httpRouteKey == nil {
+		dagor.httpRouteKey = defaultHTTPRouteKey
+	}
+	if dagor.httpMethodKey == nil {
+		dagor.httpMethodKey = defaultHTTPMethodKey
+	}
+	if dagor.signatureTTL <= 0 {
+		dagor.signatureTTL = defaultSignatureTTL
+	}
+	if dagor.healthFloorWindows <= 0 {
+		dagor.healthFloorWindows = defaultHealthFloorWindows
+	}
+	// copy the routes, a B outside [1, Bmax] would index past the counters
+	dagor.httpRoutes = make([]HTTPRoute, len(params.HTTPRoutes))
+	for i, route := range params.HTTPRoutes {
+		if route.B < 1 || route.B > dagor.Bmax {
+			logger("HTTP route %s %s has B %d outside [1, %d], using %d", route.Method, route.Path, route.B, dagor.Bmax, dagor.Bmax)
+			route.B = dagor.Bmax
 		}
+		dagor.httpRoutes[i] = route
+	}
+	if dagor.connectionFloorWindows <= 0 {
+		dagor.connectionFloorWindows = defaultConnectionFloorWindows
+	}
+	if dagor.connectionDelay <= 0 {
+		dagor.connectionDelay = dagor.admissionLevelUpdateInterval
+	}
+	if dagor.connectionDelay <= 0 {
+		dagor.connectionDelay = time.Second
+	}
+	if dagor.probeInterval <= 0 {
+		dagor.probeInterval = dagor.admissionLevelUpdateInterval
+	}
+	if dagor.probeInterval <= 0 {
+		dagor.probeInterval = time.Second
+	}
+	if dagor.clock == nil {
+		dagor.clock = realClock{}
+	}
+	// use a private random source instead of reseeding the global math/rand
+	if params.RandSource != nil {
+		dagor.rng = rand.New(params.RandSource)
 	} else {
-		// Initialize the C matrix with the initial counters for each B, U pair
-		dagor.CM.Reset()
+		dagor.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
 	}
+	if params.MaxConcurrency > 0 {
+		dagor.scheduler = newScheduler(dagor.clock, params.MaxConcurrency)
+	}
+	dagor.admissionLevel.Store(dagor.newAdmissionLevel(dagor.Bmax, dagor.Umax))
+
+	// Initialize the double-buffered counter windows for each B, U pair
+	dagor.window.Store(newCounterWindow(dagor.newCounters()))
+	dagor.spare = newCounterWindow(dagor.newCounters())
 
-	if !dagor.isEnduser {
+	if !dagor.isEnduser && !params.ManualUpdate {
 		// go run updateAdmissionLevel(dagor)
-		go dagor.UpdateAdmissionLevel()
+		go dagor.updateAdmissionLevel(dagor.clock.NewTicker(dagor.admissionLevelUpdateInterval))
 	}
 
 	// log all the parameters
@@ -113,5 +295,28 @@ func NewDagorNode(params DagorParam) *Dagor {
 	debug = params.Debug
 	logger("Debug: %v", debug)
 	logger("Use sync map: %v", dagor.UseSyncMap)
+	logger("Use sharded counters: %v", dagor.UseShardedCounters)
+	logger("Metadata keys: %s, %s, %s, legacy keys: %v", dagor.priorityKey, dagor.levelKey, dagor.signatureKey, dagor.sendLegacyMetadata)
+	logger("Signing key ID: %q, signature policy: %v, signature TTL: %v", dagor.signingKeyID, dagor.signaturePolicy, dagor.signatureTTL)
+	logger("Unknown method policy: %v, default business: %v", dagor.unknownMethodPolicy, dagor.defaultBusiness)
+	logger("User ID fallback: %v, accept business hints: %v", dagor.userIDFallback, dagor.acceptBusinessHints)
+	logger("Echo priority: %v, pre-throttle: %v, probe interval: %v", dagor.echoPriority, dagor.preThrottle, dagor.probeInterval)
+	logger("Retry policy: %+v", dagor.retryPolicy)
+	logger("Dry run: %v", dagor.dryRun)
+	logger("Health service: %q, floor windows: %v, enabled: %v", dagor.healthService, dagor.healthFloorWindows, dagor.healthServer != nil)
+	logger("Load reporter: %v", dagor.loadReporter != nil)
+	logger("Max concurrency: %v", params.MaxConcurrency)
+	logger("Connection policy: %v, floor windows: %v, delay: %v", dagor.connectionPolicy, dagor.connectionFloorWindows, dagor.connectionDelay)
+	logger("HTTP routes: %v, reject status: %v", dagor.httpRoutes, dagor.httpRejectStatus)
+	logger("Bypass methods: %v, prefixes: %v", params.BypassMethods, dagor.bypassPrefixes)
+	logger("Trust boundary: %v, trusted peers: %v", dagor.trustBoundary, dagor.trustedPeer != nil)
+	if dagor.entryService && dagor.trustBoundary {
+		// untrusted callers are classified by their full method name, their method override is stripped
+		for method := range dagor.businessMap {
+			if !strings.HasPrefix(method, "/") {
+				logger("[Entry service] business map entry %q is not a full method name, untrusted callers never match it behind the trust boundary", method)
+			}
+		}
+	}
 	return &dagor
 }
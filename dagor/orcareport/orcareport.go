@@ -0,0 +1,76 @@
+// Package orcareport publishes the load of a DAGOR node through ORCA (Open Request Cost Aggregation),
+// in the out-of-band reports and the per-call reports, so that weighted_round_robin and custom balancers
+// can steer traffic away from overloaded backends. It is kept apart from the dagor package, which would
+// otherwise pull in the xDS dependencies of google.golang.org/grpc/orca.
+package orcareport
+
+import (
+	"context"
+	"time"
+
+	"github.com/Jiali-Xing/dagor-grpc/dagor"
+	"google.golang.org/grpc/orca"
+)
+
+// Names of the DAGOR metrics in the ORCA load reports.
+const (
+	QueuingDelayMetric      = "dagor.queuing_delay_ms"   // Queuing delay of the last window in milliseconds
+	AdmissionLevelMetric    = "dagor.admission_level"    // Admission level normalized to [0, 1], 1 admits every priority: lower is busier
+	AdmissionPressureMetric = "dagor.admission_pressure" // 1 - the normalized admission level, 0 admits every priority: higher is busier
+	ShedRatioMetric         = "dagor.shed_ratio"         // Fraction of the requests dropped in the last window
+)
+
+// namedMetricRecorder is implemented by the recorder of orca.NewServerMetricsRecorder, whose named metrics
+// the ORCA service sends in the out-of-band reports too.
+type namedMetricRecorder interface {
+	SetNamedMetric(name string, val float64)
+}
+
+// Reporter is a dagor.LoadReporter publishing the DAGOR load to ORCA, set it as DagorParam.LoadReporter.
+type Reporter struct {
+	recorder orca.ServerMetricsRecorder
+}
+
+// NewReporter creates a Reporter updating recorder every window, for the out-of-band reports. Register the
+// recorder with orca.Register, and install orca.CallMetricsServerOption before the DAGOR interceptor for the
+// per-call reports.
+func NewReporter(recorder orca.ServerMetricsRecorder) *Reporter {
+	return &Reporter{recorder: recorder}
+}
+
+// ReportLoad updates the recorder with the state of the window that just ended. The queuing delay relative
+// to QueuingThresh is the application utilization, which the weighted_round_robin balancer weighs backends
+// with; the admission pressure and shed ratio are named utilizations, higher when busier like every ORCA
+// utilization. The queuing delay and the admission level, which is lower when busier, are named metrics if the
+// recorder supports them, as the one of orca.NewServerMetricsRecorder does.
+func (r *Reporter) ReportLoad(report dagor.LoadReport) {
+	r.recorder.SetApplicationUtilization(report.Utilization)
+	r.recorder.SetNamedUtilization(AdmissionPressureMetric, admissionPressure(report))
+	r.recorder.SetNamedUtilization(ShedRatioMetric, report.ShedRatio)
+	if named, ok := r.recorder.(namedMetricRecorder); ok {
+		named.SetNamedMetric(QueuingDelayMetric, queuingDelayMs(report))
+		named.SetNamedMetric(AdmissionLevelMetric, report.AdmissionLevel)
+	}
+}
+
+// ReportCallLoad adds the DAGOR metrics to the per-call ORCA report, if the server reports per-call metrics
+// with orca.CallMetricsServerOption.
+func (r *Reporter) ReportCallLoad(ctx context.Context, report dagor.LoadReport) {
+	recorder := orca.CallMetricsRecorderFromContext(ctx)
+	if recorder == nil {
+		return
+	}
+	recorder.SetNamedMetric(QueuingDelayMetric, queuingDelayMs(report))
+	recorder.SetNamedMetric(AdmissionLevelMetric, report.AdmissionLevel)
+	recorder.SetNamedMetric(AdmissionPressureMetric, admissionPressure(report))
+	recorder.SetNamedMetric(ShedRatioMetric, report.ShedRatio)
+}
+
+// admissionPressure turns the admission level, 1 when idle, into a utilization, 0 when idle.
+func admissionPressure(report dagor.LoadReport) float64 {
+	return 1 - report.AdmissionLevel
+}
+
+func queuingDelayMs(report dagor.LoadReport) float64 {
+	return float64(report.QueuingDelay) / float64(time.Millisecond)
+}
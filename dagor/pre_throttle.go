@@ -0,0 +1,128 @@
+package dagor
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// maxEntryLevels bounds the number of (method, user, hint) entries an end user caches. A BFF or load generator
+// sending calls for many users would otherwise grow the cache forever; beyond the bound, the least recently used
+// half is evicted, and is learned again from the next responses.
+const maxEntryLevels = 4096
+
+// entryLevel is what an end user learned from the entry service about its calls to one method: the priority
+// the entry assigned to them and the admission level of the entry, both echoed in the response headers.
+type entryLevel struct {
+	mu        sync.Mutex
+	B, U      int
+	Bstar     int
+	Ustar     int
+	nextProbe time.Time // While the entry rejects (B, U), calls are dropped locally until then, except for one probe
+	lastUsed  time.Time // Last call or response for the entry, to evict the least recently used ones
+}
+
+type entryLevelKey struct {
+	method string
+	userID string
+	hint   int // Business priority hint of the calls, 0 if none
+}
+
+// preThrottleReject returns the error dropping an end user call locally because the entry service is shedding its
+// priority, or nil. One call per jittered probe interval is still sent, to learn when the entry recovers.
+func (d *Dagor) preThrottleReject(key entryLevelKey) error {
+	val, ok := d.entryLevels.Load(key)
+	if !ok {
+		return nil
+	}
+	l := val.(*entryLevel)
+	now := d.clock.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lastUsed = now
+	if Admits(l.B, l.U, l.Bstar, l.Ustar) {
+		return nil
+	}
+	if now.Before(l.nextProbe) {
+		return newRejection(Rejection{Reason: ReasonLocalDrop, Node: d.nodeName, B: l.B, U: l.U, Bstar: l.Bstar, Ustar: l.Ustar, RetryDelay: l.nextProbe.Sub(now)}, msgLocalReject)
+	}
+	l.nextProbe = now.Add(d.probeDelay())
+	if debug {
+		logger("[End User] %s probing the entry service for method %s", key.userID, key.method)
+	}
+	return nil
+}
+
+// learnEntryLevel records the priority and the admission level echoed by the entry service in a response header.
+func (d *Dagor) learnEntryLevel(key entryLevelKey, header metadata.MD) {
+	vals := header[d.priorityKey]
+	if len(vals) == 0 {
+		return
+	}
+	p, ok := decodePriority(vals[len(vals)-1])
+	if !ok {
+		return
+	}
+	Bstar, Ustar, ok := d.receivedLevel(header)
+	if !ok {
+		return
+	}
+	now := d.clock.Now()
+	val, ok := d.entryLevels.Load(key)
+	if !ok {
+		if val, ok = d.entryLevels.LoadOrStore(key, &entryLevel{lastUsed: now}); !ok && d.entryLevelCount.Add(1) > maxEntryLevels {
+			d.evictEntryLevels()
+		}
+	}
+	l := val.(*entryLevel)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.B, l.U, l.Bstar, l.Ustar = p.B, p.U, Bstar, Ustar
+	l.lastUsed = now
+	if !Admits(p.B, p.U, Bstar, Ustar) && !now.Before(l.nextProbe) {
+		l.nextProbe = now.Add(d.probeDelay())
+	}
+	if debug {
+		logger("[End User] %s learned B, U %d, %d and B*, U* %d, %d for method %s", key.userID, p.B, p.U, Bstar, Ustar, key.method)
+	}
+}
+
+// evictEntryLevels removes the least recently used half of the cached entries, once their number exceeds
+// maxEntryLevels. Only one caller evicts at a time, the others keep going.
+func (d *Dagor) evictEntryLevels() {
+	if !d.entryLevelsEvicting.TryLock() {
+		return
+	}
+	defer d.entryLevelsEvicting.Unlock()
+	type used struct {
+		key      entryLevelKey
+		lastUsed time.Time
+	}
+	var entries []used
+	d.entryLevels.Range(func(key, val interface{}) bool {
+		l := val.(*entryLevel)
+		l.mu.Lock()
+		entries = append(entries, used{key: key.(entryLevelKey), lastUsed: l.lastUsed})
+		l.mu.Unlock()
+		return true
+	})
+	if len(entries) <= maxEntryLevels {
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].lastUsed.Before(entries[j].lastUsed) })
+	for _, e := range entries[:len(entries)-maxEntryLevels/2] {
+		if _, ok := d.entryLevels.LoadAndDelete(e.key); ok {
+			d.entryLevelCount.Add(-1)
+		}
+	}
+	if debug {
+		logger("[End User] %s evicted the %d least recently used entry levels", d.nodeName, len(entries)-maxEntryLevels/2)
+	}
+}
+
+// probeDelay returns the probe interval with a uniform jitter of ±50%, so that end users do not probe in sync.
+func (d *Dagor) probeDelay() time.Duration {
+	return d.probeInterval/2 + time.Duration(d.randIntn(int(d.probeInterval)+1))
+}
@@ -106,6 +106,18 @@ func maximumQueuingDelayms(earlier, later *metrics.Float64Histogram) float64 {
 	return 0
 }
 
+// msToDuration converts a delay in milliseconds read from a histogram bucket into a time.Duration,
+// clamping the infinite boundary buckets.
+func msToDuration(ms float64) time.Duration {
+	if math.IsNaN(ms) || ms <= 0 {
+		return 0
+	}
+	if ms >= float64(math.MaxInt64/int64(time.Millisecond)) {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
 func busyLoop(c chan<- int, quit chan bool) {
 	for {
 		if <-quit {
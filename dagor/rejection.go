@@ -0,0 +1,165 @@
+package dagor
+
+import (
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Reasons of the DAGOR rejections, in the ErrorInfo detail of their status.
+const (
+	ReasonServerReject = "DAGOR_SERVER_REJECT" // Dropped by the admission control of a server
+	ReasonLocalDrop    = "DAGOR_LOCAL_DROP"    // Dropped by a client before sending, from the B* and U* of the downstream
+)
+
+// ErrorInfoDomain is the domain of the ErrorInfo detail of the DAGOR rejections.
+const ErrorInfoDomain = "dagor"
+
+// Rejection describes a request dropped by DAGOR.
+type Rejection struct {
+	Reason     string
+	Node       string // Node that dropped the request
+	B          int
+	U          int
+	Bstar      int
+	Ustar      int
+	RetryDelay time.Duration // Time until the admission level may change
+}
+
+// localDropError is a rejection by this process, which IsLocalDrop tells apart from the statuses received
+// from a server once it crossed the wire.
+type localDropError struct {
+	st  *status.Status
+	msg string
+}
+
+func (e *localDropError) Error() string {
+	return e.msg
+}
+
+func (e *localDropError) GRPCStatus() *status.Status {
+	return e.st
+}
+
+// newRejection builds the ResourceExhausted status of a rejection, with ErrorInfo and RetryInfo details.
+func newRejection(r Rejection, msg string) error {
+	st := status.New(codes.ResourceExhausted, msg)
+	if detailed, err := st.WithDetails(
+		&errdetails.ErrorInfo{
+			Reason: r.Reason,
+			Domain: ErrorInfoDomain,
+			Metadata: map[string]string{
+				"node":   r.Node,
+				"b":      strconv.Itoa(r.B),
+				"u":      strconv.Itoa(r.U),
+				"b_star": strconv.Itoa(r.Bstar),
+				"u_star": strconv.Itoa(r.Ustar),
+			},
+		},
+		&errdetails.RetryInfo{RetryDelay: durationpb.New(r.RetryDelay)},
+	); err == nil {
+		st = detailed
+	}
+	if r.Reason == ReasonLocalDrop {
+		return &localDropError{st: st, msg: st.Err().Error()}
+	}
+	return st.Err()
+}
+
+// rejections lazily builds and caches the rejection errors of one admission level, one per priority,
+// so that dropping a request does not allocate once its error was built.
+type rejections struct {
+	reason     string
+	msg        string
+	node       string
+	Bstar      int
+	Ustar      int
+	bMax       int
+	uMax       int
+	retryDelay time.Duration
+	errs       []atomic.Pointer[error]
+}
+
+func (d *Dagor) newRejections(reason, msg string, Bstar, Ustar int) *rejections {
+	return &rejections{
+		reason:     reason,
+		msg:        msg,
+		node:       d.nodeName,
+		Bstar:      Bstar,
+		Ustar:      Ustar,
+		bMax:       d.Bmax,
+		uMax:       d.Umax,
+		retryDelay: d.admissionLevelUpdateInterval,
+		errs:       make([]atomic.Pointer[error], d.Bmax*d.Umax),
+	}
+}
+
+// get returns the rejection error of priority (B, U).
+func (r *rejections) get(B, U int) error {
+	if B < 1 || B > r.bMax || U < 1 || U > r.uMax {
+		return r.build(B, U)
+	}
+	slot := &r.errs[(B-1)*r.uMax+(U-1)]
+	if err := slot.Load(); err != nil {
+		return *err
+	}
+	// concurrent drops may both build the error, either is fine
+	err := r.build(B, U)
+	slot.Store(&err)
+	return err
+}
+
+func (r *rejections) build(B, U int) error {
+	return newRejection(Rejection{Reason: r.reason, Node: r.node, B: B, U: U, Bstar: r.Bstar, Ustar: r.Ustar, RetryDelay: r.retryDelay}, r.msg)
+}
+
+// IsRejected reports whether err is a DAGOR rejection, by a server or dropped locally.
+func IsRejected(err error) bool {
+	_, ok := RejectionInfo(err)
+	return ok
+}
+
+// IsLocalDrop reports whether err is a request dropped by this process before it was sent.
+func IsLocalDrop(err error) bool {
+	var local *localDropError
+	return errors.As(err, &local)
+}
+
+// RejectionInfo returns the details of a DAGOR rejection. A request refused by TapHandle is reported with
+// its reason only: gRPC drops the details of the statuses returned before the stream is set up.
+func RejectionInfo(err error) (Rejection, bool) {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.ResourceExhausted {
+		return Rejection{}, false
+	}
+	var r Rejection
+	found := false
+	for _, detail := range st.Details() {
+		switch detail := detail.(type) {
+		case *errdetails.ErrorInfo:
+			if detail.GetDomain() != ErrorInfoDomain {
+				continue
+			}
+			found = true
+			md := detail.GetMetadata()
+			r.Reason = detail.GetReason()
+			r.Node = md["node"]
+			r.B, _ = strconv.Atoi(md["b"])
+			r.U, _ = strconv.Atoi(md["u"])
+			r.Bstar, _ = strconv.Atoi(md["b_star"])
+			r.Ustar, _ = strconv.Atoi(md["u_star"])
+		case *errdetails.RetryInfo:
+			r.RetryDelay = detail.GetRetryDelay().AsDuration()
+		}
+	}
+	if !found && st.Message() == msgServerReject {
+		return Rejection{Reason: ReasonServerReject}, true
+	}
+	return r, found
+}
@@ -0,0 +1,120 @@
+package dagor
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// RetryPolicy configures RetryingUnaryInterceptorClient. Zero fields take their defaults.
+type RetryPolicy struct {
+	MaxAttempts       int           // Attempts per call including the first, defaults to 3
+	InitialBackoff    time.Duration // Backoff before the first retry, defaults to 100ms
+	MaxBackoff        time.Duration // Cap of the backoff, defaults to 5s
+	BackoffMultiplier float64       // Growth of the backoff per retry, defaults to 2
+	BudgetRatio       float64       // Retries allowed per call, defaults to 0.1
+	BudgetBurst       float64       // Retries that can be saved up while calls succeed, defaults to 10
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 3
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = 100 * time.Millisecond
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = 5 * time.Second
+	}
+	if p.BackoffMultiplier < 1 {
+		p.BackoffMultiplier = 2
+	}
+	if p.BudgetRatio <= 0 {
+		p.BudgetRatio = 0.1
+	}
+	if p.BudgetBurst <= 0 {
+		p.BudgetBurst = 10
+	}
+	return p
+}
+
+// retryBudget is a token bucket: every call deposits BudgetRatio tokens and every retry withdraws one,
+// so that retries never add more than BudgetRatio to the load of an overloaded entry service.
+type retryBudget struct {
+	mu     sync.Mutex
+	tokens float64
+	ratio  float64
+	burst  float64
+}
+
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	b.tokens = math.Min(b.tokens+b.ratio, b.burst)
+	b.mu.Unlock()
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// RetryingUnaryInterceptorClient is the end user interceptor of UnaryInterceptorClient, retrying the calls
+// rejected by DAGOR. Only server rejections are retried, never calls dropped locally nor other errors.
+// Retries back off exponentially with jitter, at least as long as the retry delay of the rejection,
+// and stop when the retry budget, the attempts or the deadline of the call run out.
+func (d *Dagor) RetryingUnaryInterceptorClient(ctx context.Context, method string, req interface{}, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	d.retryBudget.deposit()
+	backoff := d.retryPolicy.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := d.UnaryInterceptorClient(ctx, method, req, reply, cc, invoker, opts...)
+		if err == nil || IsLocalDrop(err) || attempt >= d.retryPolicy.MaxAttempts {
+			return err
+		}
+		info, ok := RejectionInfo(err)
+		if !ok {
+			return err
+		}
+		// jitter the backoff by ±50%, so that rejected users do not retry in sync
+		delay := backoff/2 + time.Duration(d.randIntn(int(backoff)+1))
+		if delay < info.RetryDelay {
+			delay = info.RetryDelay
+		}
+		// the deadline of ctx expires on the wall clock, whatever the clock of the node
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return err
+		}
+		if !d.retryBudget.withdraw() {
+			if debug {
+				logger("[End User] retry budget exhausted, not retrying the call to %s", method)
+			}
+			return err
+		}
+		if debug {
+			logger("[End User] call to %s rejected by %s, retrying in %v", method, info.Node, delay)
+		}
+		if err := d.sleep(ctx, delay); err != nil {
+			return err
+		}
+		backoff = time.Duration(math.Min(float64(backoff)*d.retryPolicy.BackoffMultiplier, float64(d.retryPolicy.MaxBackoff)))
+	}
+}
+
+// sleep waits for the given duration on the node's clock, or until ctx is done.
+func (d *Dagor) sleep(ctx context.Context, duration time.Duration) error {
+	ticker := d.clock.NewTicker(duration)
+	defer ticker.Stop()
+	select {
+	case <-ticker.C():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
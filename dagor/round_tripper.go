@@ -0,0 +1,118 @@
+package dagor
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// HTTPRouteKeyFunc returns the key of the threshold table for an outgoing HTTP request, which should not
+// depend on request specific path segments like IDs.
+type HTTPRouteKeyFunc func(req *http.Request) string
+
+// defaultHTTPRouteKey keys the threshold table by host and path, with the path segments that look like IDs
+// replaced by {id}.
+func defaultHTTPRouteKey(req *http.Request) string {
+	return req.URL.Host + routePath(req.URL.Path)
+}
+
+type roundTripper struct {
+	d    *Dagor
+	next http.RoundTripper
+}
+
+// RoundTripper is the net/http equivalent of UnaryInterceptorClient, wrapping next, or http.DefaultTransport
+// if nil. End users send their user ID, DAGOR nodes send the priority of the request being served and drop
+// the requests below the B* and U* learned from the downstream, keyed by HTTPRouteKey.
+// The headers are the same as the ones of HTTPMiddleware.
+func (d *Dagor) RoundTripper(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &roundTripper{d: d, next: next}
+}
+
+func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	d := rt.d
+	if d.bypassed(req.URL.Path) {
+		return rt.next.RoundTrip(req)
+	}
+	ctx := req.Context()
+	routeKey := d.httpRouteKey(req)
+	// a RoundTripper must not modify the request it is given
+	req = req.Clone(ctx)
+
+	if d.isEnduser {
+		userID := d.callUserID(ctx, nil)
+		req.Header.Set(UserIDKey, userID)
+		if !d.preThrottle {
+			return rt.next.RoundTrip(req)
+		}
+		key := entryLevelKey{method: routeKey, userID: userID}
+		if err := d.preThrottleReject(key); err != nil {
+			if !d.dryRun {
+				if debug {
+					logger("[End User] %s dropped a request to %s locally, the entry service is shedding its priority", userID, routeKey)
+				}
+				closeBody(req)
+				return nil, err
+			}
+			d.recordDryRunDrop(routeKey, err)
+		}
+		resp, err := rt.next.RoundTrip(req)
+		if err == nil {
+			d.learnEntryLevel(key, httpMetadata(resp.Header))
+		}
+		return resp, err
+	}
+
+	p, ok := d.outgoingPriority(ctx)
+	if !ok {
+		if debug {
+			logger("[Client Sending Req] not an enduser and B or U not found in the context, fatal error")
+		}
+		closeBody(req)
+		return nil, errNoOutgoingB
+	}
+	if err := d.localReject(routeKey, p.B, p.U); err != nil {
+		if !d.dryRun {
+			if debug {
+				logger("[Ratelimiting] B %d or U %d value above the threshold B* or U* of route %s, request dropped", p.B, p.U, routeKey)
+			}
+			closeBody(req)
+			return nil, err
+		}
+		d.recordDryRunDrop(routeKey, err)
+	}
+
+	// Send the B and U, one hop further from the entry service
+	p.Hops++
+	req.Header.Set(d.priorityKey, encodeBinHeader(encodePriority(p)))
+	if sig := d.signPriority(p, signedHTTPMethod(req)); sig != "" {
+		req.Header.Set(d.signatureKey, encodeBinHeader(sig))
+	}
+	if d.sendLegacyMetadata {
+		req.Header.Set(legacyBKey, strconv.Itoa(p.B))
+		req.Header.Set(legacyUKey, strconv.Itoa(p.U))
+	}
+
+	resp, err := rt.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	// unlike gRPC errors, HTTP rejections carry the B* and U* header too
+	if Bstar, Ustar, ok := d.receivedLevel(httpMetadata(resp.Header)); ok {
+		d.StoreThreshold(routeKey, Bstar, Ustar)
+		if debug {
+			logger("Received B* and U* values from the header: B*=%d, U*=%d", Bstar, Ustar)
+		}
+	}
+	return resp, nil
+}
+
+// closeBody closes the body of a request dropped before it is sent, as the http.RoundTripper contract
+// requires on errors too.
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
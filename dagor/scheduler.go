@@ -0,0 +1,157 @@
+package dagor
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/status"
+)
+
+// scheduler bounds the number of admitted requests running at once. The requests beyond the bound wait in
+// a queue ordered by (B, U), first come first served among equal priorities, so that a high priority request
+// overtakes the lower priority ones already waiting. The time spent in the queue is the queuing delay the
+// admission level is adjusted from.
+type scheduler struct {
+	clock     Clock
+	mu        sync.Mutex
+	limit     int
+	running   int
+	queue     waiterQueue
+	seq       uint64
+	waitSum   time.Duration // Total wait of the requests started in the current window
+	waitCount int64         // Number of requests started in the current window
+}
+
+// waiter is a request waiting in the queue of the scheduler.
+type waiter struct {
+	B, U     int
+	seq      uint64
+	enqueued time.Time
+	ready    chan struct{} // Closed when the request is handed a slot
+	index    int           // Index in the queue, -1 once removed from it
+}
+
+func newScheduler(clock Clock, limit int) *scheduler {
+	return &scheduler{clock: clock, limit: limit}
+}
+
+// acquire waits for a slot to run a request with priority (B, U), or for ctx to be done.
+func (s *scheduler) acquire(ctx context.Context, B, U int) error {
+	s.mu.Lock()
+	if s.running < s.limit && len(s.queue) == 0 {
+		s.running++
+		s.waitCount++
+		s.mu.Unlock()
+		return nil
+	}
+	w := &waiter{B: B, U: U, seq: s.seq, enqueued: s.clock.Now(), ready: make(chan struct{})}
+	s.seq++
+	heap.Push(&s.queue, w)
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		if w.index >= 0 {
+			heap.Remove(&s.queue, w.index)
+			s.mu.Unlock()
+			return status.FromContextError(ctx.Err()).Err()
+		}
+		s.mu.Unlock()
+		// the slot was handed over while ctx was done, pass it on
+		s.release()
+		return status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// release frees the slot of a finished request, handing it to the highest priority waiting request if any.
+func (s *scheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) == 0 {
+		s.running--
+		return
+	}
+	w := heap.Pop(&s.queue).(*waiter)
+	s.waitSum += s.clock.Now().Sub(w.enqueued)
+	s.waitCount++
+	close(w.ready)
+}
+
+// queuingDelay returns the queuing delay of the window that just ended, and starts a new one: the average time
+// the requests started during the window waited in the queue, those started right away included, or the age
+// of the oldest request still waiting if longer. Without the latter, a node whose slots are all held by slow
+// handlers would start no request, and report no delay, in the worst of an overload.
+func (s *scheduler) queuingDelay() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var delay time.Duration
+	if s.waitCount > 0 {
+		delay = s.waitSum / time.Duration(s.waitCount)
+	}
+	s.waitSum, s.waitCount = 0, 0
+	now := s.clock.Now()
+	for _, w := range s.queue {
+		if age := now.Sub(w.enqueued); age > delay {
+			delay = age
+		}
+	}
+	return delay
+}
+
+// waiterQueue is a heap of waiting requests, ordered by B, then U, then arrival.
+type waiterQueue []*waiter
+
+func (q waiterQueue) Len() int { return len(q) }
+
+func (q waiterQueue) Less(i, j int) bool {
+	a, b := q[i], q[j]
+	if a.B != b.B {
+		return a.B < b.B
+	}
+	if a.U != b.U {
+		return a.U < b.U
+	}
+	return a.seq < b.seq
+}
+
+func (q waiterQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *waiterQueue) Push(x interface{}) {
+	w := x.(*waiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+
+func (q *waiterQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	w := old[n-1]
+	old[n-1] = nil
+	w.index = -1
+	*q = old[:n-1]
+	return w
+}
+
+// acquireSlot waits for the scheduler to run a request with priority (B, U), if MaxConcurrency is set.
+func (d *Dagor) acquireSlot(ctx context.Context, B, U int) error {
+	if d.scheduler == nil {
+		return nil
+	}
+	return d.scheduler.acquire(ctx, B, U)
+}
+
+// releaseSlot frees the slot of a request run by the scheduler, if MaxConcurrency is set.
+func (d *Dagor) releaseSlot() {
+	if d.scheduler != nil {
+		d.scheduler.release()
+	}
+}
@@ -2,7 +2,6 @@ package dagor
 
 import (
 	"context"
-	"math/rand"
 	"runtime/metrics"
 	"strconv"
 	"time"
@@ -13,130 +12,71 @@ import (
 	"google.golang.org/grpc/status"
 )
 
-var currentThresholdB int = 0 // Initialize with default value
-var currentThresholdU int = 0 // Initialize with default value
-var currentThresholdBVal interface{}
-var currentThresholdUVal interface{}
+var (
+	errNoMethod        = status.Error(codes.InvalidArgument, "Method name not provided in metadata")
+	errNoUserID        = status.Error(codes.InvalidArgument, "User ID not provided in metadata")
+	errNoPriority      = status.Error(codes.InvalidArgument, "B or U not found in metadata, fatal error")
+	errInvalidPriority = status.Error(codes.InvalidArgument, "Invalid DAGOR priority header")
+)
+
+const msgServerReject = "[Server Admission Control] Request B, U values do not meet the threshold"
 
+// UnaryInterceptorServer is the DAGOR server interceptor. Beyond the entry service, the admit and drop
+// decision does not allocate: metadata is looked up by key, the priorities are parsed in place,
+// the drop errors and the B* and U* response header are shared per admission level. Around it, the interceptor
+// allocates once for the priority value metadata.ValueFromIncomingContext copies, and once more for the context
+// passing the priority of an admitted request to its handler, unless TapHandle admitted it (TestInterceptorAllocs).
 func (d *Dagor) UnaryInterceptorServer(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-	md, _ := metadata.FromIncomingContext(ctx)
-	methodNames, methodExists := md["method"]
+	if info != nil && d.bypassed(info.FullMethod) {
+		return handler(ctx, req)
+	}
+	ctx, trusted := d.enforceTrustBoundary(ctx)
+	methodName, ok := incomingValue(ctx, "method")
+	if !ok && info != nil {
+		methodName, ok = info.FullMethod, true
+	}
 	// Ensure method name is present
-	if !methodExists || len(methodNames) == 0 {
-		return nil, status.Errorf(codes.InvalidArgument, "Method name not provided in metadata")
+	if !ok {
+		return nil, errNoMethod
 	}
-	userIDs, userIDExists := md["user-id"]
-	var B, U int
+
+	// a request admitted by TapHandle was already decided and counted, before its message was decoded
+	admitted, tapped := tapAdmissionFrom(ctx)
+	var p Priority
+	var level *admissionLevel
 	var err error
+	if tapped {
+		p, level = admitted.p, admitted.level
+	} else if p, err = d.requestPriority(ctx, methodName, fullMethod(info, methodName), trusted); err != nil {
+		return nil, err
+	}
+	B, U := p.B, p.U
+	if d.entryService && d.echoPriority {
+		// let the end user know its priority, for pre-throttling
+		grpc.SetHeader(ctx, metadata.Pairs(d.priorityKey, encodePriority(p)))
+	}
 
-	// if this is an entry service, B and U are not in metadata
-	if d.entryService {
-		methodName := methodNames[0]
-		if businessValue, exists := d.businessMap[methodName]; exists {
-			B = businessValue
-			logger("[Entry service] Entry service found Business value %d for method %s", B, methodName)
-		} else {
-			// can't find the business value from businessMap
-			// return nil, status.Errorf(codes.Internal, "Business value for method %s not found", methodName)
-			// assign a random business value between 1 and Bmax
-			B = rand.Intn(d.Bmax) + 1
-			// make sure the business value is not yet assigned
-			for _, v := range d.businessMap {
-				if v == B {
-					B = rand.Intn(d.Bmax) + 1
-				}
-			}
-			d.businessMap[methodName] = B
-			logger("[Entry service] Entry service can't find Business value for method %s, assigned a random value %d", methodName, B)
-		}
-		if userIDExists && len(userIDs) > 0 {
-			userID := userIDs[0]
-			if val, ok := d.userPriority.Load(userID); ok {
-				U = val.(int)
-				logger("[Entry service] User %s already has a priority value assigned: %d", userID, U)
-			} else {
-				// Assign a random int for U between 1 and Umax
-				U = rand.Intn(d.Umax) + 1
-				d.userPriority.Store(userID, U)
-				logger("User %s assigned a priority value: %d", userID, U)
-			}
-		} else {
-			return nil, status.Errorf(codes.InvalidArgument, "User ID not provided in metadata")
-		}
-		logger("[Entry service] %s assigned user B: %d, U: %d", d.nodeName, B, U)
-		// Modify ctx with the B and U
-		ctx = metadata.AppendToOutgoingContext(ctx, "b", strconv.Itoa(B), "u", strconv.Itoa(U))
-	} else {
-		BValues, BExists := md["b"]
-		UValues, UExists := md["u"]
-
-		// methodName := methodNames[0]
-		// if no B or U in metadata, this is an entry service
-		if !BExists || !UExists {
-			// mark this node as entry service
-			// d.entryService = true
-			// logger("B or U not found. Node %s is assigned as an entry service", d.nodeName)
-			if !d.entryService {
-				logger("[UnaryInterceptorServer] %s is not a entry service. B or U not found in metadata, fatal error", d.nodeName)
-				return nil, status.Errorf(codes.InvalidArgument, "B or U not found in metadata, fatal error")
+	d.reportCallLoad(ctx)
+	if !tapped {
+		if level, err = d.admit(methodName, B, U); err != nil {
+			if d.entryService && d.echoPriority {
+				grpc.SetHeader(ctx, level.header)
 			}
+			return nil, err
 		}
-
-		// // Assign B based on method from businessMap or metadata
-		// if !BExists || len(BValues) == 0 {
-		// 	if businessValue, exists := d.businessMap[methodName]; exists {
-		// 		B = businessValue
-		// 	} else {
-		// 		return nil, status.Errorf(codes.Internal, "Business value for method %s not found", methodName)
-		// 	}
-		// 	logger("B value not provided in metadata, assigned B: %d", B)
-		// } else {
-		B, err = strconv.Atoi(BValues[0])
-		if err != nil {
-			return nil, status.Errorf(codes.InvalidArgument, "Invalid B value: %v", BValues[0])
-		}
-		logger("[DagorServer] B value provided in metadata: %d", B)
-		// }
-
-		// Assign U based on user-id from userPriority or metadata
-		// if !UExists || len(UValues) == 0 {
-		// 	if userIDExists && len(userIDs) > 0 {
-		// 		userID := userIDs[0]
-		// 		if val, ok := d.userPriority.Load(userID); ok {
-		// 			U = val.(int)
-		// 		} else {
-		// 			U = rand.Intn(100) // Assign a random int for U
-		// 			d.userPriority.Store(userID, U)
-		// 		}
-		// 	} else {
-		// 		return nil, status.Errorf(codes.InvalidArgument, "User ID not provided in metadata")
-		// 	}
-		// 	logger("U value not provided in metadata, assigned U: %d", U)
-		// } else {
-		U, err = strconv.Atoi(UValues[0])
-		if err != nil {
-			return nil, status.Errorf(codes.InvalidArgument, "Invalid U value: %v", UValues[0])
-		}
-		logger("[DagorServer] U value provided in metadata: %d", U)
-		// }
+		// the client interceptor propagates the priority to the sub-requests sent by the handler,
+		// TapHandle already attached it to the context of the requests it admitted
+		ctx = withPriority(ctx, p)
+	}
+	if d.entryService && d.sendLegacyMetadata {
+		ctx = metadata.AppendToOutgoingContext(ctx, legacyBKey, strconv.Itoa(B), legacyUKey, strconv.Itoa(U))
 	}
-	// Retrieve current thresholds from admissionLevel
-	currentThresholdBVal, _ := d.admissionLevel.Load("B")
-	currentThresholdUVal, _ := d.admissionLevel.Load("U")
-	currentThresholdB := currentThresholdBVal.(int) // Assert the type to int
-	currentThresholdU := currentThresholdUVal.(int) // Assert the type to int
 
-	// If the request's B and U don't meet the threshold, drop the request
-	if B < currentThresholdB || (B == currentThresholdB && U <= currentThresholdU) {
-		logger("[AQM Server Admit Req] Request B, U %d, %d values are below the threshold %d, %d", B, U, currentThresholdB, currentThresholdU)
-		// use go routine to update the histogram d.UpdateHistogram(true, B, U)
-		go d.UpdateHistogram(true, B, U)
-	} else {
-		// if B >= currentThresholdB && U >= currentThresholdU {
-		logger("[AQM Server Drop Req] Request B, U %d, %d values are above the threshold %d, %d", B, U, currentThresholdB, currentThresholdU)
-		go d.UpdateHistogram(false, B, U)
-		return nil, status.Errorf(codes.ResourceExhausted, "[Server Admission Control] Request B, U values do not meet the threshold")
+	// wait for the scheduler to run the request, in priority order
+	if err := d.acquireSlot(ctx, B, U); err != nil {
+		return nil, err
 	}
+	defer d.releaseSlot()
 
 	// Handle the request
 	resp, err := handler(ctx, req)
@@ -145,13 +85,149 @@ func (d *Dagor) UnaryInterceptorServer(ctx context.Context, req interface{}, inf
 	}
 
 	// Attach B* and U* to the response metadata
-	newMD := metadata.Pairs("b-star", strconv.Itoa(currentThresholdB), "u-star", strconv.Itoa(currentThresholdU))
-	logger("Attached B*, U* to the response metadata: B*=%d, U*=%d", currentThresholdB, currentThresholdU)
-	grpc.SendHeader(ctx, newMD)
+	if debug {
+		logger("Attached B*, U* to the response metadata: B*=%d, U*=%d", level.Bstar, level.Ustar)
+	}
+	grpc.SendHeader(ctx, level.header)
 
 	return resp, nil
 }
 
+// admit decides whether a request with priority (B, U) is admitted under the current admission level and
+// records it in the histograms. It returns the level, together with the matching response header, and the
+// rejection error if the request is dropped. In dry-run mode, the drop is only recorded.
+func (d *Dagor) admit(method string, B, U int) (*admissionLevel, error) {
+	// Retrieve current thresholds from admissionLevel, together with the matching response header
+	level := d.admissionLevel.Load()
+	currentThresholdB, currentThresholdU := level.Bstar, level.Ustar
+
+	// If the request's B and U don't meet the threshold, drop the request
+	if Admits(B, U, currentThresholdB, currentThresholdU) {
+		if debug {
+			logger("[AQM Server Admit Req] Request B, U %d, %d values are below the threshold %d, %d", B, U, currentThresholdB, currentThresholdU)
+		}
+		// update the histogram synchronously, spawning a goroutine per request would add to the scheduling latency we measure
+		d.UpdateHistogram(true, B, U)
+		return level, nil
+	}
+	if debug {
+		logger("[AQM Server Drop Req] Request B, U %d, %d values are above the threshold %d, %d", B, U, currentThresholdB, currentThresholdU)
+	}
+	d.UpdateHistogram(false, B, U)
+	if d.dryRun {
+		d.recordDryRunDrop(method, level.rejections.get(B, U))
+		return level, nil
+	}
+	return level, level.rejections.get(B, U)
+}
+
+// requestPriority returns the priority of a request to methodName: assigned by an entry service, unless a trusted
+// caller sent its own, else sent by the upstream and signed for fullMethod, the method the request was sent to.
+func (d *Dagor) requestPriority(ctx context.Context, methodName, fullMethod string, trusted bool) (Priority, error) {
+	// if this is an entry service, B and U are not in metadata
+	if d.entryService && !(trusted && d.hasIncomingPriority(ctx)) {
+		return d.entryPriority(ctx, methodName)
+	}
+	return d.incomingPriority(ctx, methodName, fullMethod)
+}
+
+// fullMethod returns the method a request was sent to, which its priority signature is bound to.
+func fullMethod(info *grpc.UnaryServerInfo, methodName string) string {
+	if info != nil {
+		return info.FullMethod
+	}
+	return methodName
+}
+
+// entryPriority assigns B from the business map and U from the user ID of the request.
+func (d *Dagor) entryPriority(ctx context.Context, methodName string) (Priority, error) {
+	B, err := d.business(ctx, methodName)
+	if err != nil {
+		return Priority{}, err
+	}
+	return d.assignPriority(ctx, methodName, B)
+}
+
+// business returns the B of a request to methodName: the hint of the end user if accepted, else the one
+// of the business map, else the one of the unknown method policy.
+func (d *Dagor) business(ctx context.Context, methodName string) (int, error) {
+	if hinted, ok := d.hintedBusiness(ctx); ok {
+		if debug {
+			logger("[Entry service] Entry service accepted Business value %d hinted for method %s", hinted, methodName)
+		}
+		return hinted, nil
+	}
+	if businessValue, exists := d.businessMap[methodName]; exists {
+		if debug {
+			logger("[Entry service] Entry service found Business value %d for method %s", businessValue, methodName)
+		}
+		return businessValue, nil
+	}
+	return d.unknownBusiness(methodName)
+}
+
+// assignPriority completes B with the U of the user the request is sent for.
+func (d *Dagor) assignPriority(ctx context.Context, methodName string, B int) (Priority, error) {
+	U, userHash, err := d.userPriorityFor(ctx, methodName)
+	if err != nil {
+		return Priority{}, err
+	}
+	if debug {
+		logger("[Entry service] %s assigned user B: %d, U: %d", d.nodeName, B, U)
+	}
+	return Priority{B: B, U: U, UserHash: userHash}, nil
+}
+
+// incomingPriority reads the priority sent by the upstream and applies the signature policy to it, for a request
+// sent to fullMethod.
+func (d *Dagor) incomingPriority(ctx context.Context, methodName, fullMethod string) (Priority, error) {
+	p, err := d.receivedPriority(ctx)
+	if err != nil {
+		return Priority{}, err
+	}
+	if d.signaturePolicy == SignatureNotRequired {
+		return p, nil
+	}
+	sig, _ := lastIncomingValue(ctx, d.signatureKey)
+	return d.checkSignature(p, sig, methodName, fullMethod)
+}
+
+// receivedPriority reads the priority sent by the upstream, from the binary header or else from the legacy b and u keys.
+func (d *Dagor) receivedPriority(ctx context.Context) (Priority, error) {
+	if vals := metadata.ValueFromIncomingContext(ctx, d.priorityKey); len(vals) > 0 {
+		// the last value was added by the closest upstream, earlier ones may have been forwarded with the metadata
+		p, ok := decodePriority(vals[len(vals)-1])
+		if !ok || p.B < 1 || p.B > d.Bmax || p.U < 1 || p.U > d.Umax {
+			return Priority{}, errInvalidPriority
+		}
+		if debug {
+			logger("[DagorServer] B, U values provided in %s: %d, %d, hops: %d", d.priorityKey, p.B, p.U, p.Hops)
+		}
+		return p, nil
+	}
+
+	BValue, BExists := incomingValue(ctx, legacyBKey)
+	UValue, UExists := incomingValue(ctx, legacyUKey)
+	if !BExists || !UExists {
+		if debug {
+			logger("[UnaryInterceptorServer] %s is not a entry service. B or U not found in metadata, fatal error", d.nodeName)
+		}
+		return Priority{}, errNoPriority
+	}
+	B, ok := parsePriority(BValue, d.Bmax)
+	if !ok {
+		return Priority{}, status.Errorf(codes.InvalidArgument, "Invalid B value: %v", BValue)
+	}
+	U, ok := parsePriority(UValue, d.Umax)
+	if !ok {
+		return Priority{}, status.Errorf(codes.InvalidArgument, "Invalid U value: %v", UValue)
+	}
+	if debug {
+		logger("[DagorServer] B, U values provided in metadata: %d, %d", B, U)
+	}
+	return Priority{B: B, U: U}, nil
+}
+
 // func (d *Dagor) UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 // 	md, _ := metadata.FromIncomingContext(ctx)
 // 	bValues := md.Get("B")
@@ -177,10 +253,54 @@ func (d *Dagor) UnaryInterceptorServer(ctx context.Context, req interface{}, inf
 // 	return resp, err
 // }
 
+// AdmissionLevel returns the current admission level (B*, U*) of the node.
+// Both values come from the same update, a request never sees a new B* together with an old U*.
+func (d *Dagor) AdmissionLevel() (int, int) {
+	level := d.admissionLevel.Load()
+	return level.Bstar, level.Ustar
+}
+
+// admissionLevel is an immutable admission level together with the response header piggybacking it and
+// the errors rejecting the requests it drops. The header is built once per level change and shared by all
+// responses, gRPC only reads it.
+type admissionLevel struct {
+	Bstar      int
+	Ustar      int
+	header     metadata.MD
+	rejections *rejections
+}
+
+func (d *Dagor) newAdmissionLevel(Bstar, Ustar int) *admissionLevel {
+	header := metadata.Pairs(d.levelKey, encodeLevel(Bstar, Ustar))
+	if d.sendLegacyMetadata {
+		header.Set(legacyBstarKey, strconv.Itoa(Bstar))
+		header.Set(legacyUstarKey, strconv.Itoa(Ustar))
+	}
+	return &admissionLevel{Bstar: Bstar, Ustar: Ustar, header: header, rejections: d.newRejections(ReasonServerReject, msgServerReject, Bstar, Ustar)}
+}
+
+// Admits reports whether a request with priority (B, U) is admitted under the admission level (B*, U*).
+// A smaller value means a higher priority, and requests are ordered by B first and U second.
+func Admits(B, U, Bstar, Ustar int) bool {
+	return B < Bstar || (B == Bstar && U <= Ustar)
+}
+
 // overloadDetection is a function that detects overload and updates the threshold
 func (d *Dagor) UpdateAdmissionLevel() {
+	d.updateAdmissionLevel(d.clock.NewTicker(d.admissionLevelUpdateInterval))
+}
+
+// updateAdmissionLevel runs the overload detection on every tick of the ticker. NewDagorNode creates the ticker
+// before starting it, so that a FakeClock advanced right after NewDagorNode returns does not miss ticks.
+func (d *Dagor) updateAdmissionLevel(ticker Ticker) {
 	var prevHist *metrics.Float64Histogram
-	for range time.Tick(d.admissionLevelUpdateInterval) {
+	defer ticker.Stop()
+	for range ticker.C() {
+		if d.scheduler != nil {
+			// the wait in the priority queue of the scheduler is the queuing delay of the requests
+			d.AdjustAdmissionLevel(d.scheduler.queuingDelay())
+			continue
+		}
 		// get the current histogram
 		currHist := readHistogram()
 
@@ -191,98 +311,67 @@ func (d *Dagor) UpdateAdmissionLevel() {
 		}
 		gapLatency := maximumQueuingDelayms(prevHist, currHist)
 
-		// // Load the current threshold values for B and U
-		// currentThresholdBVal, _ := d.admissionLevel.Load("B")
-		// currentThresholdUVal, _ := d.admissionLevel.Load("U")
-		// currentThresholdB := currentThresholdBVal.(int)
-		// currentThresholdU := currentThresholdUVal.(int)
-
 		// update the threshold
-		foverload := gapLatency > float64(d.queuingThresh.Milliseconds())
-		Bstar, Ustar := d.CalculateAdmissionLevel(foverload)
-
-		d.ResetHistogram()
-
-		// Update the admission level with the new values
-		// d.admissionLevel.Store("B", Bstar)
-		// d.admissionLevel.Store("U", Ustar)
-		// get and update the current threshold values for B and U
-		currentThresholdBVal, _ := d.admissionLevel.Swap("B", Bstar)
-		currentThresholdUVal, _ := d.admissionLevel.Swap("U", Ustar)
-
-		// If the threshold has changed, log the new values
-		if Bstar != currentThresholdBVal.(int) || Ustar != currentThresholdUVal.(int) {
-			logger("Updated admission level threshold B, U: %d, %d", Bstar, Ustar)
-		}
+		d.AdjustAdmissionLevel(msToDuration(gapLatency))
 
 		// Update prevHist for the next iteration
 		prevHist = currHist
 	}
 }
 
-// Assuming the constants alpha, beta, Bmax, Umax, and the initial N are defined elsewhere
-// and the sync.Map C is a part of the Dagor struct initialized appropriately
+// AdjustAdmissionLevel runs one window of the admission control with the given queuing delay:
+// it swaps the counter windows, computes the new B* and U* from the ended one and publishes the new admission level.
+// UpdateAdmissionLevel calls it every admissionLevelUpdateInterval; tests and simulations can call it
+// directly to step the controller deterministically.
+func (d *Dagor) AdjustAdmissionLevel(queuingDelay time.Duration) (int, int) {
+	foverload := float64(queuingDelay)/float64(time.Millisecond) > float64(d.queuingThresh.Milliseconds())
+
+	// swap in a fresh window and compute from an immutable snapshot of the one that just ended
+	d.windowMu.Lock()
+	ended := d.rotateWindow()
+	snap := ended.Snapshot()
+	Bstar, Ustar := d.calculateAdmissionLevel(snap, foverload)
+	d.recycleWindow(ended)
+
+	// publish the new threshold values for B and U
+	previous := d.admissionLevel.Load()
+	if Bstar != previous.Bstar || Ustar != previous.Ustar {
+		d.admissionLevel.Store(d.newAdmissionLevel(Bstar, Ustar))
+		// If the threshold has changed, log the new values
+		logger("Updated admission level threshold B, U: %d, %d", Bstar, Ustar)
+	}
+	d.countFloorWindows(Bstar, Ustar)
+	d.updateHealth()
+	d.reportLoad(queuingDelay, Bstar, Ustar, snap)
+	d.windowMu.Unlock()
+	return Bstar, Ustar
+}
 
+// ResetHistogram discards the counters of the current window and starts a new one.
 func (d *Dagor) ResetHistogram() {
-	// Reset the N to 0
-	d.UpdateN(0)
-	d.UpdateNadm(0)
-	// Reset the C matrix which holds the admitted request counters
-	if d.UseSyncMap {
-		d.C.Range(func(key, value interface{}) bool {
-			d.C.Store(key, int64(0))
-			return true
-		})
-	} else {
-		d.CM.Reset()
-	}
+	d.windowMu.Lock()
+	defer d.windowMu.Unlock()
+	d.recycleWindow(d.rotateWindow())
 	logger("[ResetHistogram] N and C matrix reset")
 }
 
+// UpdateHistogram records a request with priority (B, U) in the current window.
 func (d *Dagor) UpdateHistogram(admitted bool, B, U int) {
-	// Update the C matrix with the new histogram value
-	// increment the counter N
-	d.IncrementN()
-	logger("[UpdateHistogram] N incremented to %d", d.ReadN())
-	if d.UseSyncMap {
-		key := [2]int{B, U}
-		// This loop ensures that we keep trying to update the value
-		// until we are successful in case of concurrent updates
-		for {
-			// Load the current value
-			val, loaded := d.C.Load(key)
-			// Store the incremented count using CompareAndSwap
-			// This is thread-safe because it only succeeds if the value hasn't been changed by another goroutine in the meantime
-			if !loaded {
-				// If the key doesn't exist, initialize it to 1
-				// Since we are in a loop, we need to check if the initialization was successful
-				if d.C.CompareAndSwap(key, nil, int64(1)) {
-					logger("[UpdateHistogram] C [%d, %d] (B, U) counter initialized to 1", B, U)
-					break
-				}
-			} else {
-				count := val.(int64) + 1
-				// Compare and swap the value if it's still the same; otherwise, the loop will retry
-				if d.C.CompareAndSwap(key, val, count) {
-					logger("[UpdateHistogram] C [%d, %d] (B, U) counter incremented to %d", B, U, count)
-					break
-				}
-			}
-		}
-	} else {
-		// This is an alternative implementation using a map
-		d.CM.Increment(B, U)
-		logger("[UpdateHistogram] C [%d, %d] (B, U) counter incremented to %d", B, U, d.CM.Get(B, U))
-	}
-
-	if admitted {
-		d.IncrementNadm()
+	d.record(admitted, B, U)
+	if debug {
+		logger("[UpdateHistogram] C [%d, %d] (B, U) counter incremented, admitted: %v", B, U, admitted)
 	}
 }
 
-// CalculateAdmissionLevel adjusts the B and U based on the overload flag
+// CalculateAdmissionLevel adjusts the B and U based on the overload flag and the counters of the current window.
 func (d *Dagor) CalculateAdmissionLevel(foverload bool) (int, int) {
-	Nprefix := d.ReadNadm()
+	return d.calculateAdmissionLevel(d.window.Load().Snapshot(), foverload)
+}
+
+// calculateAdmissionLevel adjusts the B and U based on the overload flag and the counters of a window
+func (d *Dagor) calculateAdmissionLevel(snap CounterSnapshot, foverload bool) (int, int) {
+	N, Nadm, count := snap.N, snap.Nadm, snap.Get
+	Nprefix := Nadm
 	if Nprefix == 0 {
 		logger("[CalculateAdmissionLevel] Nprefix is 0, returning Bmax, Umax")
 		return d.Bmax, d.Umax
@@ -291,8 +380,8 @@ func (d *Dagor) CalculateAdmissionLevel(foverload bool) (int, int) {
 	var Bstar, Ustar int
 	// Adjust Nexp based on overload
 	if foverload {
-		Nexp := int64((1 - d.alpha) * float64(d.ReadNadm()))
-		logger("[CalculateAdmissionLevel] overload detected, Nexp updated from %d to %d", d.ReadNadm(), Nexp)
+		Nexp := int64((1 - d.alpha) * float64(Nadm))
+		logger("[CalculateAdmissionLevel] overload detected, Nexp updated from %d to %d", Nadm, Nexp)
 		// while Nprefix > Nexp and (B∗, U∗) > (1, 1)
 		Bstar, Ustar = d.Bmax, d.Umax
 		for Nprefix > Nexp && (Bstar > 1 || Ustar > 1) {
@@ -305,16 +394,11 @@ func (d *Dagor) CalculateAdmissionLevel(foverload bool) (int, int) {
 					Ustar = 1
 				}
 			}
-			if d.UseSyncMap {
-				val, _ := d.C.Load([2]int{Bstar, Ustar})
-				Nprefix = Nprefix - val.(int64)
-			} else {
-				Nprefix = Nprefix - d.CM.Get(Bstar, Ustar)
-			}
+			Nprefix = Nprefix - count(Bstar, Ustar)
 		}
 	} else {
-		Nexp := d.ReadNadm() + int64(d.beta*float64(d.ReadN())+1) // but take ceiling of the second term
-		logger("[CalculateAdmissionLevel] no overload detected, Nexp updated from %d to %d", d.ReadNadm(), Nexp)
+		Nexp := Nadm + int64(d.beta*float64(N)+1) // but take ceiling of the second term
+		logger("[CalculateAdmissionLevel] no overload detected, Nexp updated from %d to %d", Nadm, Nexp)
 		// while Nprefix < Nexp and (B∗, U∗) < (BH , UH ) do
 		Bstar, Ustar = 1, 1
 		for Nprefix <= Nexp && (Bstar < d.Bmax || Ustar < d.Umax) {
@@ -327,12 +411,7 @@ func (d *Dagor) CalculateAdmissionLevel(foverload bool) (int, int) {
 					Ustar = d.Umax
 				}
 			}
-			if d.UseSyncMap {
-				val, _ := d.C.Load([2]int{Bstar, Ustar})
-				Nprefix = Nprefix + val.(int64)
-			} else {
-				Nprefix = Nprefix + d.CM.Get(Bstar, Ustar)
-			}
+			Nprefix = Nprefix + count(Bstar, Ustar)
 		}
 	}
 
@@ -0,0 +1,126 @@
+package dagor
+
+import (
+	"math/rand"
+	"runtime"
+	"sync/atomic"
+)
+
+// maxCounterShards bounds the number of shards, and so the cost of summing them.
+const maxCounterShards = 64
+
+// cacheLinePad separates the counters of neighbouring shards to avoid false sharing.
+type cacheLinePad [64]byte
+
+// counterShard holds one shard of N, Nadm and the C matrix.
+type counterShard struct {
+	n     int64
+	nadm  int64
+	cells []int64 // Flattened Bmax x Umax matrix
+	_     cacheLinePad
+}
+
+// ShardedCounters spreads N, Nadm and the C matrix over several shards, so that concurrent requests
+// mostly increment different cache lines. The shards are only summed when the admission level is computed.
+type ShardedCounters struct {
+	shards []counterShard
+	mask   uint32
+	bMax   int
+	uMax   int
+}
+
+// CounterSnapshot is an immutable copy of N, Nadm and the C matrix of a window.
+type CounterSnapshot struct {
+	N     int64
+	Nadm  int64
+	cells []int64
+	uMax  int
+}
+
+func newCounterSnapshot(bMax, uMax int) CounterSnapshot {
+	return CounterSnapshot{cells: make([]int64, bMax*uMax), uMax: uMax}
+}
+
+// NewShardedCounters creates sharded counters for the given dimensions, with one shard per P rounded up to a power of two.
+func NewShardedCounters(bMax, uMax int) *ShardedCounters {
+	n := 1
+	for n < runtime.GOMAXPROCS(0) && n < maxCounterShards {
+		n <<= 1
+	}
+	sc := &ShardedCounters{
+		shards: make([]counterShard, n),
+		mask:   uint32(n - 1),
+		bMax:   bMax,
+		uMax:   uMax,
+	}
+	for i := range sc.shards {
+		// over-allocate by a cache line so that the cells of two shards never share one
+		sc.shards[i].cells = make([]int64, bMax*uMax, bMax*uMax+8)
+	}
+	return sc
+}
+
+// shard picks a shard for the calling goroutine. The global math/rand functions are backed by a
+// per-P generator when the global source has not been seeded, so this does not contend either.
+func (sc *ShardedCounters) shard() *counterShard {
+	return &sc.shards[rand.Uint32()&sc.mask]
+}
+
+// Add records a request with priority (B, U) in N, in the C matrix and, if admitted, in Nadm.
+func (sc *ShardedCounters) Add(admitted bool, B, U int) {
+	s := sc.shard()
+	atomic.AddInt64(&s.n, 1)
+	atomic.AddInt64(&s.cells[(B-1)*sc.uMax+(U-1)], 1)
+	if admitted {
+		atomic.AddInt64(&s.nadm, 1)
+	}
+}
+
+// Snapshot sums all shards.
+func (sc *ShardedCounters) Snapshot() CounterSnapshot {
+	snap := newCounterSnapshot(sc.bMax, sc.uMax)
+	for i := range sc.shards {
+		s := &sc.shards[i]
+		snap.N += atomic.LoadInt64(&s.n)
+		snap.Nadm += atomic.LoadInt64(&s.nadm)
+		for j := range s.cells {
+			snap.cells[j] += atomic.LoadInt64(&s.cells[j])
+		}
+	}
+	return snap
+}
+
+// Totals sums N and Nadm over all shards, without copying the C matrix.
+func (sc *ShardedCounters) Totals() (int64, int64) {
+	var N, Nadm int64
+	for i := range sc.shards {
+		s := &sc.shards[i]
+		N += atomic.LoadInt64(&s.n)
+		Nadm += atomic.LoadInt64(&s.nadm)
+	}
+	return N, Nadm
+}
+
+// AddTotals adds to N and Nadm of one shard, leaving the C matrix untouched.
+func (sc *ShardedCounters) AddTotals(N, Nadm int64) {
+	s := sc.shard()
+	atomic.AddInt64(&s.n, N)
+	atomic.AddInt64(&s.nadm, Nadm)
+}
+
+// Reset sets all counters of all shards to zero. It must not run concurrently with Add.
+func (sc *ShardedCounters) Reset() {
+	for i := range sc.shards {
+		s := &sc.shards[i]
+		atomic.StoreInt64(&s.n, 0)
+		atomic.StoreInt64(&s.nadm, 0)
+		for j := range s.cells {
+			atomic.StoreInt64(&s.cells[j], 0)
+		}
+	}
+}
+
+// Get returns the summed counter for the given B and U.
+func (s CounterSnapshot) Get(B, U int) int64 {
+	return s.cells[(B-1)*s.uMax+(U-1)]
+}
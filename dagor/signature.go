@@ -0,0 +1,108 @@
+package dagor
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// SignaturePolicy tells a DAGOR node what to do with a request whose priority is not signed, or not
+// signed with a valid signature.
+type SignaturePolicy int
+
+const (
+	// SignatureNotRequired does not verify signatures, priorities are trusted as received.
+	SignatureNotRequired SignaturePolicy = iota
+	// SignatureReject rejects the request with PermissionDenied.
+	SignatureReject
+	// SignatureDemote serves the request with the lowest priority (Bmax, Umax).
+	SignatureDemote
+)
+
+var errInvalidSignature = status.Error(codes.PermissionDenied, "DAGOR priority is not signed or has an invalid signature")
+
+// defaultSignatureTTL is how long a signature stays valid after it was made, if SignatureTTL is not set.
+const defaultSignatureTTL = 30 * time.Second
+
+// signatureVersion is the version of the <prefix>-sig-bin header. Version 1 signatures, which were not bound to
+// a method nor expired, are rejected.
+const signatureVersion = 2
+
+// signatureLen is the length of an HMAC-SHA256.
+const signatureLen = sha256.Size
+
+// signPriority signs the B, U and user hash of p for a request to method, the full gRPC method name or the
+// "METHOD /path" of an HTTP request, valid for signatureTTL. It returns the value of the <prefix>-sig-bin header:
+// version (1 byte), key ID length (1 byte), key ID, expiry in Unix seconds (8 bytes) and HMAC-SHA256, or "" if no
+// signing key is configured. The hop count is not signed since every hop increments it.
+func (d *Dagor) signPriority(p Priority, method string) string {
+	key, ok := d.signingKeys[d.signingKeyID]
+	if d.signingKeyID == "" || !ok {
+		return ""
+	}
+	expiry := d.clock.Now().Add(d.signatureTTL).Unix()
+	buf := make([]byte, 0, 2+len(d.signingKeyID)+8+signatureLen)
+	buf = append(buf, signatureVersion, byte(len(d.signingKeyID)))
+	buf = append(buf, d.signingKeyID...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(expiry))
+	buf = appendPriorityMAC(buf, key, p, expiry, method)
+	return string(buf)
+}
+
+// verifyPriority checks that sig is an unexpired signature of p for a request to method, with the key it names.
+func (d *Dagor) verifyPriority(p Priority, sig, method string) bool {
+	if len(sig) < 2 || sig[0] < signatureVersion {
+		return false
+	}
+	idLen := int(sig[1])
+	if len(sig) != 2+idLen+8+signatureLen {
+		return false
+	}
+	key, ok := d.signingKeys[sig[2:2+idLen]]
+	if !ok {
+		return false
+	}
+	expiry := int64(uint64BE(sig[2+idLen:]))
+	if d.clock.Now().Unix() > expiry {
+		return false
+	}
+	var mac [signatureLen]byte
+	return hmac.Equal(appendPriorityMAC(mac[:0], key, p, expiry, method), []byte(sig[2+idLen+8:]))
+}
+
+// appendPriorityMAC appends the HMAC-SHA256 of the signed fields of p, the expiry and the method to buf.
+func appendPriorityMAC(buf, key []byte, p Priority, expiry int64, method string) []byte {
+	var payload [21]byte
+	payload[0] = signatureVersion
+	binary.BigEndian.PutUint16(payload[1:], uint16(p.B))
+	binary.BigEndian.PutUint16(payload[3:], uint16(p.U))
+	binary.BigEndian.PutUint64(payload[5:], p.UserHash)
+	binary.BigEndian.PutUint64(payload[13:], uint64(expiry))
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload[:])
+	mac.Write([]byte(method))
+	return mac.Sum(buf)
+}
+
+// checkSignature applies the signature policy to a priority received from upstream with the signature sig,
+// for a request to fullMethod. methodName is the method the request is accounted to.
+func (d *Dagor) checkSignature(p Priority, sig, methodName, fullMethod string) (Priority, error) {
+	if d.verifyPriority(p, sig, fullMethod) {
+		return p, nil
+	}
+	if d.signaturePolicy == SignatureReject {
+		if d.dryRun {
+			// serve the request with the priority it claims
+			d.recordDryRunPolicyDrop(methodName, ReasonInvalidSignature)
+			return p, nil
+		}
+		logger("[DagorServer] %s rejected a request with a missing or invalid priority signature", d.nodeName)
+		return Priority{}, errInvalidSignature
+	}
+	logger("[DagorServer] %s demoted a request with a missing or invalid priority signature", d.nodeName)
+	return Priority{B: d.Bmax, U: d.Umax, UserHash: p.UserHash, Hops: p.Hops}, nil
+}
@@ -0,0 +1,158 @@
+package dagor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const signedMethod = "/signed.Service/Method"
+
+var signingKeys = map[string][]byte{"old": []byte("old secret"), "new": []byte("new secret")}
+
+func newSigningNode(clock Clock, keyID string, keys map[string][]byte, policy SignaturePolicy) *Dagor {
+	return NewDagorNode(DagorParam{NodeName: "signing", Bmax: 4, Umax: 8, AdmissionLevelUpdateInterval: time.Second, ManualUpdate: true,
+		Clock: clock, SigningKeys: keys, SigningKeyID: keyID, SignaturePolicy: policy, SignatureTTL: time.Minute})
+}
+
+func TestSignatureVerifies(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	d := newSigningNode(clock, "new", signingKeys, SignatureReject)
+	p := Priority{B: 1, U: 2, UserHash: 42, Hops: 1}
+	sig := d.signPriority(p, signedMethod)
+	if sig == "" {
+		t.Fatal("signPriority returned no signature with a signing key")
+	}
+	if !d.verifyPriority(p, sig, signedMethod) {
+		t.Error("signature does not verify for the method it was made for")
+	}
+	// the hop count changes at every hop and is not signed
+	p.Hops = 5
+	if !d.verifyPriority(p, sig, signedMethod) {
+		t.Error("signature does not verify after a hop")
+	}
+}
+
+func TestSignatureRejectsReplay(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	d := newSigningNode(clock, "new", signingKeys, SignatureReject)
+	p := Priority{B: 1, U: 1, UserHash: 42}
+	sig := d.signPriority(p, signedMethod)
+
+	tests := []struct {
+		name   string
+		p      Priority
+		method string
+	}{
+		{"other method", p, "/signed.Service/Other"},
+		{"other B", Priority{B: 2, U: 1, UserHash: 42}, signedMethod},
+		{"other U", Priority{B: 1, U: 2, UserHash: 42}, signedMethod},
+		{"other user", Priority{B: 1, U: 1, UserHash: 7}, signedMethod},
+	}
+	for _, tt := range tests {
+		if d.verifyPriority(tt.p, sig, tt.method) {
+			t.Errorf("signature verifies for %s", tt.name)
+		}
+	}
+
+	clock.Advance(time.Minute)
+	if !d.verifyPriority(p, sig, signedMethod) {
+		t.Error("signature expired before SignatureTTL")
+	}
+	clock.Advance(time.Second)
+	if d.verifyPriority(p, sig, signedMethod) {
+		t.Error("signature still verifies after SignatureTTL")
+	}
+}
+
+func TestSignatureKeyRotation(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	p := Priority{B: 1, U: 1, UserHash: 42}
+	verifier := newSigningNode(clock, "", signingKeys, SignatureReject)
+	for _, keyID := range []string{"old", "new"} {
+		signer := newSigningNode(clock, keyID, signingKeys, SignatureReject)
+		if !verifier.verifyPriority(p, signer.signPriority(p, signedMethod), signedMethod) {
+			t.Errorf("signature with key %q does not verify while both keys are configured", keyID)
+		}
+	}
+
+	// once the old key is retired, its signatures no longer verify
+	retired := newSigningNode(clock, "", map[string][]byte{"new": signingKeys["new"]}, SignatureReject)
+	oldSigner := newSigningNode(clock, "old", signingKeys, SignatureReject)
+	if retired.verifyPriority(p, oldSigner.signPriority(p, signedMethod), signedMethod) {
+		t.Error("signature with a retired key verifies")
+	}
+
+	// a key with the same ID but another secret does not verify either
+	forged := newSigningNode(clock, "new", map[string][]byte{"new": []byte("guessed")}, SignatureReject)
+	if verifier.verifyPriority(p, forged.signPriority(p, signedMethod), signedMethod) {
+		t.Error("signature with a wrong secret verifies")
+	}
+}
+
+// forward sends a sub-request with priority p through the client interceptor of from, and returns the incoming
+// context the server interceptor of a downstream would see for it.
+func forward(t *testing.T, from *Dagor, p Priority, method string) context.Context {
+	t.Helper()
+	var sent metadata.MD
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		sent, _ = metadata.FromOutgoingContext(ctx)
+		return nil
+	}
+	if err := from.UnaryInterceptorClient(withPriority(context.Background(), p), method, nil, nil, nil, invoker); err != nil {
+		t.Fatalf("UnaryInterceptorClient: %v", err)
+	}
+	ctx := grpc.NewContextWithServerTransportStream(context.Background(), benchStream{})
+	return metadata.NewIncomingContext(ctx, sent)
+}
+
+// serve runs a request through the server interceptor of d, and returns the priority its handler sees.
+func serve(d *Dagor, ctx context.Context, method string) (Priority, error) {
+	var got Priority
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		got, _ = PriorityFromContext(ctx)
+		return nil, nil
+	}
+	_, err := d.UnaryInterceptorServer(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+	return got, err
+}
+
+func TestSignaturePolicies(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	signer := newSigningNode(clock, "new", signingKeys, SignatureReject)
+	unsigned := newSigningNode(clock, "", nil, SignatureNotRequired)
+	p := Priority{B: 1, U: 1, UserHash: 42}
+
+	tests := []struct {
+		name    string
+		from    *Dagor
+		sentTo  string
+		policy  SignaturePolicy
+		want    Priority
+		wantErr codes.Code
+	}{
+		{"signed", signer, signedMethod, SignatureReject, Priority{B: 1, U: 1, UserHash: 42, Hops: 1}, codes.OK},
+		{"unsigned rejected", unsigned, signedMethod, SignatureReject, Priority{}, codes.PermissionDenied},
+		{"unsigned demoted", unsigned, signedMethod, SignatureDemote, Priority{B: 4, U: 8, UserHash: 42, Hops: 1}, codes.OK},
+		{"replayed to another method rejected", signer, "/signed.Service/Other", SignatureReject, Priority{}, codes.PermissionDenied},
+		{"replayed to another method demoted", signer, "/signed.Service/Other", SignatureDemote, Priority{B: 4, U: 8, UserHash: 42, Hops: 1}, codes.OK},
+		{"unsigned trusted", unsigned, signedMethod, SignatureNotRequired, Priority{B: 1, U: 1, UserHash: 42, Hops: 1}, codes.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier := newSigningNode(clock, "", signingKeys, tt.policy)
+			got, err := serve(verifier, forward(t, tt.from, p, signedMethod), tt.sentTo)
+			if code := status.Code(err); code != tt.wantErr {
+				t.Fatalf("got code %v, want %v", code, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("handler got priority %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
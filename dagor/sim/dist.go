@@ -0,0 +1,116 @@
+package sim
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Distribution samples service times.
+type Distribution interface {
+	Sample(r *rand.Rand) time.Duration
+}
+
+// Constant always returns the same duration.
+type Constant time.Duration
+
+func (c Constant) Sample(*rand.Rand) time.Duration { return time.Duration(c) }
+
+// Exponential samples durations with the given mean.
+type Exponential struct {
+	Mean time.Duration
+}
+
+func (e Exponential) Sample(r *rand.Rand) time.Duration {
+	return time.Duration(r.ExpFloat64() * float64(e.Mean))
+}
+
+// Uniform samples durations uniformly from [Min, Max].
+type Uniform struct {
+	Min, Max time.Duration
+}
+
+func (u Uniform) Sample(r *rand.Rand) time.Duration {
+	if u.Max <= u.Min {
+		return u.Min
+	}
+	return u.Min + time.Duration(r.Int63n(int64(u.Max-u.Min)+1))
+}
+
+// LogNormal samples durations whose logarithm is normal with the given parameters,
+// i.e. Median is exp(mu) and Sigma is the standard deviation of the logarithm.
+type LogNormal struct {
+	Median time.Duration
+	Sigma  float64
+}
+
+func (l LogNormal) Sample(r *rand.Rand) time.Duration {
+	return time.Duration(float64(l.Median) * math.Exp(l.Sigma*r.NormFloat64()))
+}
+
+// ArrivalProcess generates the arrival times of root requests.
+type ArrivalProcess interface {
+	// Next returns the gap between the arrival at virtual time now and the following one.
+	// A non-positive gap means that no more requests arrive.
+	Next(r *rand.Rand, now time.Duration) time.Duration
+}
+
+// Poisson is an open-loop arrival process with exponentially distributed gaps.
+type Poisson struct {
+	Rate float64 // requests per second
+}
+
+func (p Poisson) Next(r *rand.Rand, _ time.Duration) time.Duration {
+	if p.Rate <= 0 {
+		return 0
+	}
+	return minGap(time.Duration(r.ExpFloat64() / p.Rate * float64(time.Second)))
+}
+
+// Periodic is an arrival process with evenly spaced requests.
+type Periodic struct {
+	Rate float64 // requests per second
+}
+
+func (p Periodic) Next(*rand.Rand, time.Duration) time.Duration {
+	if p.Rate <= 0 {
+		return 0
+	}
+	return minGap(time.Duration(float64(time.Second) / p.Rate))
+}
+
+// minGap rounds a gap shorter than the clock resolution up to 1ns, as a gap of 0 would end the arrivals.
+func minGap(gap time.Duration) time.Duration {
+	if gap < time.Nanosecond {
+		return time.Nanosecond
+	}
+	return gap
+}
+
+// Phase is one step of a Phased arrival process.
+type Phase struct {
+	Until   time.Duration // Virtual time at which the phase ends
+	Process ArrivalProcess
+}
+
+// Phased switches between arrival processes over time, e.g. to ramp the load up and down.
+// Phases must be sorted by Until; no requests arrive after the last phase.
+type Phased []Phase
+
+func (p Phased) Next(r *rand.Rand, now time.Duration) time.Duration {
+	for _, phase := range p {
+		if now < phase.Until {
+			gap := phase.Process.Next(r, now)
+			if gap <= 0 {
+				// an idle phase, resume in the next one
+				next := p.Next(r, phase.Until)
+				if next <= 0 {
+					return 0
+				}
+				return phase.Until - now + next
+			}
+			return gap
+		}
+	}
+	return 0
+}
@@ -0,0 +1,190 @@
+package sim
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// Priority is a (B, U) pair.
+type Priority struct {
+	B, U int
+}
+
+// Counts counts root requests.
+type Counts struct {
+	Sent      int64
+	Succeeded int64
+}
+
+// SuccessRate returns the share of the sent requests that succeeded.
+func (c *Counts) SuccessRate() float64 {
+	if c.Sent == 0 {
+		return 0
+	}
+	return float64(c.Succeeded) / float64(c.Sent)
+}
+
+// LevelSample is the admission level of a node at the end of one window.
+type LevelSample struct {
+	At           time.Duration // Virtual time of the update
+	QueuingDelay time.Duration // Queuing delay fed to the controller
+	Bstar        int
+	Ustar        int
+}
+
+// NodeResult holds the per-node outcome of a simulation.
+type NodeResult struct {
+	Name         string
+	Levels       []LevelSample // Admission level after every window
+	Dropped      int64         // Requests rejected by the server side admission control
+	LocalDropped int64         // Sub-requests rejected by the local admission control before being sent
+	// ConvergenceTime is the virtual time after which the admission level stayed within
+	// ConvergenceTolerance levels of its final value.
+	ConvergenceTime time.Duration
+}
+
+// Result is the outcome of a simulation.
+type Result struct {
+	Duration   time.Duration // Virtual time simulated
+	Total      Counts
+	Goodput    float64 // Successful root requests per second of virtual time
+	ByPriority map[Priority]*Counts
+	ByBusiness map[int]*Counts // Keyed by B
+	ByMethod   map[string]*Counts
+	Nodes      map[string]*NodeResult
+	// ConvergenceTime is the largest ConvergenceTime of all nodes.
+	ConvergenceTime time.Duration
+	latency         time.Duration // Sum of the latencies of the successful root requests
+}
+
+func newResult() *Result {
+	return &Result{
+		ByPriority: make(map[Priority]*Counts),
+		ByBusiness: make(map[int]*Counts),
+		ByMethod:   make(map[string]*Counts),
+		Nodes:      make(map[string]*NodeResult),
+	}
+}
+
+func (r *Result) counts(method string, B, U int) []*Counts {
+	p := Priority{B, U}
+	if r.ByPriority[p] == nil {
+		r.ByPriority[p] = &Counts{}
+	}
+	if r.ByBusiness[B] == nil {
+		r.ByBusiness[B] = &Counts{}
+	}
+	if r.ByMethod[method] == nil {
+		r.ByMethod[method] = &Counts{}
+	}
+	return []*Counts{&r.Total, r.ByPriority[p], r.ByBusiness[B], r.ByMethod[method]}
+}
+
+func (r *Result) sent(method string, B, U int) {
+	for _, c := range r.counts(method, B, U) {
+		c.Sent++
+	}
+}
+
+func (r *Result) completed(method string, B, U int, ok bool, latency time.Duration) {
+	if !ok {
+		return
+	}
+	for _, c := range r.counts(method, B, U) {
+		c.Succeeded++
+	}
+	r.latency += latency
+}
+
+func (r *Result) node(name string) *NodeResult {
+	if r.Nodes[name] == nil {
+		r.Nodes[name] = &NodeResult{Name: name}
+	}
+	return r.Nodes[name]
+}
+
+func (r *Result) dropped(name string, local bool) {
+	if local {
+		r.node(name).LocalDropped++
+	} else {
+		r.node(name).Dropped++
+	}
+}
+
+// MeanLatency returns the mean latency of the successful root requests.
+func (r *Result) MeanLatency() time.Duration {
+	if r.Total.Succeeded == 0 {
+		return 0
+	}
+	return r.latency / time.Duration(r.Total.Succeeded)
+}
+
+func (r *Result) finish(s *simulation) {
+	r.Duration = s.cfg.Duration
+	if r.Duration > 0 {
+		r.Goodput = float64(r.Total.Succeeded) / r.Duration.Seconds()
+	}
+	umax := s.cfg.Params.Umax
+	for _, n := range s.order {
+		nr := r.node(n.spec.Name)
+		nr.Levels = n.levels
+		nr.ConvergenceTime = convergenceTime(n.levels, umax, s.cfg.ConvergenceTolerance)
+		if nr.ConvergenceTime > r.ConvergenceTime {
+			r.ConvergenceTime = nr.ConvergenceTime
+		}
+	}
+}
+
+// convergenceTime returns the time of the last sample deviating from the final level by more than tolerance.
+func convergenceTime(levels []LevelSample, umax, tolerance int) time.Duration {
+	if len(levels) == 0 {
+		return 0
+	}
+	position := func(l LevelSample) int { return (l.Bstar-1)*umax + l.Ustar }
+	final := position(levels[len(levels)-1])
+	for i := len(levels) - 1; i >= 0; i-- {
+		diff := position(levels[i]) - final
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff > tolerance {
+			return levels[i].At
+		}
+	}
+	return 0
+}
+
+// Report writes a human readable summary of r to w.
+func (r *Result) Report(w io.Writer) {
+	fmt.Fprintf(w, "duration %v, sent %d, succeeded %d (%.2f%%), goodput %.1f req/s, mean latency %v\n",
+		r.Duration, r.Total.Sent, r.Total.Succeeded, 100*r.Total.SuccessRate(), r.Goodput, r.MeanLatency())
+	fmt.Fprintf(w, "convergence time %v\n", r.ConvergenceTime)
+
+	businesses := make([]int, 0, len(r.ByBusiness))
+	for B := range r.ByBusiness {
+		businesses = append(businesses, B)
+	}
+	sort.Ints(businesses)
+	for _, B := range businesses {
+		c := r.ByBusiness[B]
+		fmt.Fprintf(w, "  B=%d\tsent %d\tsucceeded %d\t(%.2f%%)\n", B, c.Sent, c.Succeeded, 100*c.SuccessRate())
+	}
+
+	names := make([]string, 0, len(r.Nodes))
+	for name := range r.Nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		n := r.Nodes[name]
+		Bstar, Ustar := 0, 0
+		if len(n.Levels) > 0 {
+			last := n.Levels[len(n.Levels)-1]
+			Bstar, Ustar = last.Bstar, last.Ustar
+		}
+		fmt.Fprintf(w, "  node %s\tdropped %d\tlocally dropped %d\tfinal level (%d, %d)\tconverged at %v\n",
+			name, n.Dropped, n.LocalDropped, Bstar, Ustar, n.ConvergenceTime)
+	}
+}
@@ -0,0 +1,426 @@
+// Package sim is an in-process discrete-event simulator for the DAGOR admission controller.
+//
+// It drives a set of simulated DAGOR nodes in virtual time with synthetic arrival processes,
+// service time distributions, business and user mixes and fan-out call graphs. Every node is a real
+// *dagor.Dagor: root requests enter through UnaryInterceptorServer of their entry node, which assigns their
+// priority from its business map and the user ID and admits them; downstream, admission uses dagor.Admits on
+// the node's admission level and accounting uses UpdateHistogram. The admission level is recomputed by
+// AdjustAdmissionLevel (and so CalculateAdmissionLevel) once per window, and sub-requests go through the same
+// local admission control with the piggybacked B* and U*.
+//
+// Each node is modeled as a pool of workers in front of a FIFO queue. The queuing delay fed to the
+// controller is the longest time a request waited for a worker during the window.
+package sim
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/Jiali-Xing/dagor-grpc/dagor"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Node describes one simulated service.
+type Node struct {
+	Name        string
+	Workers     int          // Number of requests served concurrently
+	ServiceTime Distribution // Local processing time of a request
+	Calls       []string     // Downstream nodes called in parallel once the local processing is done
+}
+
+// Business is one entry method of the workload.
+type Business struct {
+	Method string  // Method name, the key of the business map of the entry node and used for reporting
+	Entry  string  // Name of the entry node receiving the method
+	B      int     // Business priority of the method in the business map of the entry node
+	Weight float64 // Relative share of the arrivals
+}
+
+// Config describes a simulation.
+type Config struct {
+	Nodes      []Node
+	Businesses []Business
+	Users      int            // Number of distinct user IDs, the entry node assigns each a random U
+	Arrival    ArrivalProcess // Arrivals of root requests
+	Duration   time.Duration  // Virtual time simulated; in-flight requests are still drained at the end
+	Latency    time.Duration  // One-way network latency of every hop
+	Timeout    time.Duration  // A root request finishing later than this does not count as goodput, 0 means none
+	// Params is the template for the DAGOR parameters of every node. NodeName, EntryService, IsEnduser,
+	// Clock, RandSource and ManualUpdate are set by the simulator, and the businesses are added to the
+	// BusinessMap of their entry node.
+	Params dagor.DagorParam
+	// ConvergenceTolerance is the number of admission levels a node may deviate from its final level
+	// and still be considered converged.
+	ConvergenceTolerance int
+	Seed                 int64
+}
+
+type event struct {
+	at  time.Duration
+	seq uint64
+	fn  func()
+}
+
+type eventQueue []*event
+
+func (q eventQueue) Len() int { return len(q) }
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].at != q[j].at {
+		return q[i].at < q[j].at
+	}
+	return q[i].seq < q[j].seq
+}
+func (q eventQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *eventQueue) Push(x interface{}) { *q = append(*q, x.(*event)) }
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+type job struct {
+	B, U     int
+	enqueued time.Duration
+	done     func(ok bool)
+}
+
+type node struct {
+	spec    Node
+	dagor   *dagor.Dagor
+	busy    int
+	queue   []*job
+	maxWait time.Duration // Longest queuing delay seen in the current window
+	levels  []LevelSample
+}
+
+type simulation struct {
+	cfg    Config
+	rng    *rand.Rand
+	clock  *dagor.FakeClock
+	start  time.Time
+	now    time.Duration
+	seq    uint64
+	events eventQueue
+	nodes  map[string]*node
+	order  []*node
+	result *Result
+}
+
+// Run runs the simulation described by cfg and reports its outcome.
+func Run(cfg Config) (*Result, error) {
+	s, err := newSimulation(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.run()
+	return s.result, nil
+}
+
+func newSimulation(cfg Config) (*simulation, error) {
+	if cfg.Params.AdmissionLevelUpdateInterval <= 0 {
+		return nil, fmt.Errorf("sim: AdmissionLevelUpdateInterval must be positive")
+	}
+	if cfg.Params.Bmax < 1 || cfg.Params.Umax < 1 {
+		return nil, fmt.Errorf("sim: Bmax and Umax must be at least 1")
+	}
+	if cfg.Arrival == nil {
+		return nil, fmt.Errorf("sim: no arrival process")
+	}
+	if cfg.Users < 1 {
+		cfg.Users = 1
+	}
+	s := &simulation{
+		cfg:    cfg,
+		rng:    rand.New(rand.NewSource(cfg.Seed)),
+		start:  time.Unix(0, 0),
+		nodes:  make(map[string]*node),
+		result: newResult(),
+	}
+	s.clock = dagor.NewFakeClock(s.start)
+
+	// the business map of every entry node, on top of the one of the template
+	entries := make(map[string]map[string]int)
+	for _, b := range cfg.Businesses {
+		if b.B < 1 || b.B > cfg.Params.Bmax {
+			return nil, fmt.Errorf("sim: business %q has B %d outside [1, %d]", b.Method, b.B, cfg.Params.Bmax)
+		}
+		if entries[b.Entry] == nil {
+			entries[b.Entry] = make(map[string]int, len(cfg.Params.BusinessMap))
+			for method, B := range cfg.Params.BusinessMap {
+				entries[b.Entry][method] = B
+			}
+		}
+		entries[b.Entry][b.Method] = b.B
+	}
+	for _, spec := range cfg.Nodes {
+		if _, ok := s.nodes[spec.Name]; ok {
+			return nil, fmt.Errorf("sim: duplicate node %q", spec.Name)
+		}
+		if spec.Workers < 1 {
+			return nil, fmt.Errorf("sim: node %q needs at least one worker", spec.Name)
+		}
+		if spec.ServiceTime == nil {
+			spec.ServiceTime = Constant(0)
+		}
+		params := cfg.Params
+		params.NodeName = spec.Name
+		if businessMap, ok := entries[spec.Name]; ok {
+			params.EntryService = true
+			params.BusinessMap = businessMap
+		} else {
+			params.EntryService = false
+		}
+		params.IsEnduser = false
+		params.Clock = s.clock
+		params.RandSource = rand.NewSource(s.rng.Int63())
+		params.ManualUpdate = true
+		n := &node{spec: spec, dagor: dagor.NewDagorNode(params)}
+		s.nodes[spec.Name] = n
+		s.order = append(s.order, n)
+	}
+	for _, n := range s.order {
+		for _, to := range n.spec.Calls {
+			if _, ok := s.nodes[to]; !ok {
+				return nil, fmt.Errorf("sim: node %q calls unknown node %q", n.spec.Name, to)
+			}
+		}
+	}
+	if err := s.checkAcyclic(); err != nil {
+		return nil, err
+	}
+	for _, b := range cfg.Businesses {
+		if _, ok := s.nodes[b.Entry]; !ok {
+			return nil, fmt.Errorf("sim: business %q enters at unknown node %q", b.Method, b.Entry)
+		}
+	}
+	if len(cfg.Businesses) == 0 {
+		return nil, fmt.Errorf("sim: no business")
+	}
+	return s, nil
+}
+
+// checkAcyclic rejects call graphs with a cycle, whose requests would fan out forever.
+func (s *simulation) checkAcyclic() error {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int, len(s.order))
+	var visit func(n *node) error
+	visit = func(n *node) error {
+		switch state[n.spec.Name] {
+		case visiting:
+			return fmt.Errorf("sim: call graph has a cycle through node %q", n.spec.Name)
+		case done:
+			return nil
+		}
+		state[n.spec.Name] = visiting
+		for _, to := range n.spec.Calls {
+			if err := visit(s.nodes[to]); err != nil {
+				return err
+			}
+		}
+		state[n.spec.Name] = done
+		return nil
+	}
+	for _, n := range s.order {
+		if err := visit(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schedule runs fn after delay of virtual time.
+func (s *simulation) schedule(delay time.Duration, fn func()) {
+	s.seq++
+	heap.Push(&s.events, &event{at: s.now + delay, seq: s.seq, fn: fn})
+}
+
+func (s *simulation) run() {
+	interval := s.cfg.Params.AdmissionLevelUpdateInterval
+	for _, n := range s.order {
+		n := n
+		var tick func()
+		tick = func() {
+			s.adjust(n)
+			if s.now+interval <= s.cfg.Duration {
+				s.schedule(interval, tick)
+			}
+		}
+		s.schedule(interval, tick)
+	}
+
+	var arrive func()
+	arrive = func() {
+		s.arrive()
+		if gap := s.cfg.Arrival.Next(s.rng, s.now); gap > 0 && s.now+gap < s.cfg.Duration {
+			s.schedule(gap, arrive)
+		}
+	}
+	if gap := s.cfg.Arrival.Next(s.rng, 0); gap > 0 && gap < s.cfg.Duration {
+		s.schedule(gap, arrive)
+	}
+
+	for s.events.Len() > 0 {
+		e := heap.Pop(&s.events).(*event)
+		if e.at > s.now {
+			s.clock.Advance(e.at - s.now)
+			s.now = e.at
+		}
+		e.fn()
+	}
+	s.result.finish(s)
+}
+
+// adjust closes the current window of n and feeds its queuing delay to the controller.
+func (s *simulation) adjust(n *node) {
+	delay := n.maxWait
+	// requests still waiting count with the delay they have accumulated so far
+	if len(n.queue) > 0 && s.now-n.queue[0].enqueued > delay {
+		delay = s.now - n.queue[0].enqueued
+	}
+	n.maxWait = 0
+	Bstar, Ustar := n.dagor.AdjustAdmissionLevel(delay)
+	n.levels = append(n.levels, LevelSample{At: s.now, QueuingDelay: delay, Bstar: Bstar, Ustar: Ustar})
+}
+
+// arrive creates a root request of a random user and sends it to its entry node.
+func (s *simulation) arrive() {
+	business := s.pickBusiness()
+	userID := fmt.Sprintf("user%d", s.rng.Intn(s.cfg.Users))
+	start := s.now
+	n := s.nodes[business.Entry]
+	s.schedule(s.cfg.Latency, func() {
+		B, U := s.enter(n, business.Method, userID, func(B, U int, ok bool) {
+			s.schedule(s.cfg.Latency, func() {
+				if ok && s.cfg.Timeout > 0 && s.now-start > s.cfg.Timeout {
+					ok = false
+				}
+				s.result.completed(business.Method, B, U, ok, s.now-start)
+			})
+		})
+		s.result.sent(business.Method, B, U)
+	})
+}
+
+// enter runs a root request through the server interceptor of its entry node n, which assigns its priority
+// and admits it. It returns the priority, and done receives it with whether the whole call tree succeeded.
+func (s *simulation) enter(n *node, method, userID string, done func(B, U int, ok bool)) (B, U int) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(dagor.UserIDKey, userID))
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		p, _ := dagor.PriorityFromContext(ctx)
+		B, U = p.B, p.U
+		// the handler only queues the request, the simulator serves it in virtual time
+		n.queue = append(n.queue, &job{B: B, U: U, enqueued: s.now, done: func(ok bool) { done(B, U, ok) }})
+		s.dispatch(n)
+		return nil, nil
+	}
+	if _, err := n.dagor.UnaryInterceptorServer(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, handler); err != nil {
+		if rejection, ok := dagor.RejectionInfo(err); ok {
+			B, U = rejection.B, rejection.U
+		}
+		s.result.dropped(n.spec.Name, false)
+		done(B, U, false)
+	}
+	return B, U
+}
+
+func (s *simulation) pickBusiness() Business {
+	total := 0.0
+	for _, b := range s.cfg.Businesses {
+		total += b.Weight
+	}
+	if total <= 0 {
+		return s.cfg.Businesses[s.rng.Intn(len(s.cfg.Businesses))]
+	}
+	x := s.rng.Float64() * total
+	for _, b := range s.cfg.Businesses {
+		x -= b.Weight
+		if x < 0 {
+			return b
+		}
+	}
+	return s.cfg.Businesses[len(s.cfg.Businesses)-1]
+}
+
+// call sends a request to n over the network, done receives whether the whole call tree succeeded.
+func (s *simulation) call(n *node, B, U int, done func(ok bool)) {
+	s.schedule(s.cfg.Latency, func() {
+		s.receive(n, B, U, func(ok bool) {
+			s.schedule(s.cfg.Latency, func() { done(ok) })
+		})
+	})
+}
+
+// receive runs the server side admission control of n for a sub-request.
+func (s *simulation) receive(n *node, B, U int, done func(ok bool)) {
+	Bstar, Ustar := n.dagor.AdmissionLevel()
+	admitted := dagor.Admits(B, U, Bstar, Ustar)
+	n.dagor.UpdateHistogram(admitted, B, U)
+	if !admitted {
+		s.result.dropped(n.spec.Name, false)
+		done(false)
+		return
+	}
+	n.queue = append(n.queue, &job{B: B, U: U, enqueued: s.now, done: done})
+	s.dispatch(n)
+}
+
+// dispatch starts queued jobs on the free workers of n.
+func (s *simulation) dispatch(n *node) {
+	for n.busy < n.spec.Workers && len(n.queue) > 0 {
+		j := n.queue[0]
+		n.queue[0] = nil
+		n.queue = n.queue[1:]
+		if wait := s.now - j.enqueued; wait > n.maxWait {
+			n.maxWait = wait
+		}
+		n.busy++
+		s.schedule(n.spec.ServiceTime.Sample(s.rng), func() {
+			n.busy--
+			s.dispatch(n)
+			s.fanOut(n, j)
+		})
+	}
+}
+
+// fanOut calls the downstreams of n for j, and completes j once all of them replied.
+func (s *simulation) fanOut(n *node, j *job) {
+	pending := len(n.spec.Calls)
+	if pending == 0 {
+		j.done(true)
+		return
+	}
+	ok := true
+	reply := func(childOK bool) {
+		ok = ok && childOK
+		pending--
+		if pending == 0 {
+			j.done(ok)
+		}
+	}
+	for _, to := range n.spec.Calls {
+		down := s.nodes[to]
+		// local admission control against the threshold learned from the downstream
+		if !n.dagor.LocalAdmit(to, j.B, j.U) {
+			s.result.dropped(n.spec.Name, true)
+			reply(false)
+			continue
+		}
+		s.call(down, j.B, j.U, func(childOK bool) {
+			if childOK {
+				// the response piggybacks the admission level of the downstream, like the b-star and u-star headers
+				b, u := down.dagor.AdmissionLevel()
+				n.dagor.StoreThreshold(to, b, u)
+			}
+			reply(childOK)
+		})
+	}
+}
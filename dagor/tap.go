@@ -0,0 +1,53 @@
+package dagor
+
+import (
+	"context"
+
+	"google.golang.org/grpc/tap"
+)
+
+// tapAdmissionFrom returns the priority context TapHandle attached to a request it admitted, if any.
+func tapAdmissionFrom(ctx context.Context) (*priorityCtx, bool) {
+	c, ok := priorityFrom(ctx)
+	if !ok || c.level == nil {
+		return nil, false
+	}
+	return c, true
+}
+
+// TapHandle is a tap.ServerInHandle making the DAGOR admission decision from the request headers alone,
+// install it with grpc.InTapHandle. A dropped request is refused before its stream is set up and its message
+// read and decoded, with the code and message of the UnaryInterceptorServer rejections. An admitted request
+// is counted once: UnaryInterceptorServer, which must still be installed, reuses the decision instead of taking
+// it again. Requests whose priority can't be determined are left to UnaryInterceptorServer, which rejects them.
+// In dry-run mode, where no request is refused, every request is left to UnaryInterceptorServer, so that
+// OnDryRunDrop is never called from TapHandle.
+//
+// gRPC runs TapHandle on the transport goroutine with the lock of the connection held, blocking its other streams.
+// The user ID extractors of an entry service and TrustedPeer are called from it: they must be cheap, must not
+// block and must not use the connection of the request. A refused request gets no response header and gRPC
+// drops the details of its status: the end user learns neither its priority nor the admission level, and
+// RejectionInfo reports the reason only.
+func (d *Dagor) TapHandle(ctx context.Context, info *tap.Info) (context.Context, error) {
+	if d.dryRun || d.bypassed(info.FullMethodName) {
+		return ctx, nil
+	}
+	// gRPC has already added the incoming metadata, info.Header, to ctx
+	mdCtx, trusted := d.enforceTrustBoundary(ctx)
+	methodName, ok := incomingValue(mdCtx, "method")
+	if !ok {
+		methodName = info.FullMethodName
+	}
+	p, err := d.requestPriority(mdCtx, methodName, info.FullMethodName, trusted)
+	if err != nil {
+		return ctx, nil
+	}
+	level, err := d.admit(methodName, p.B, p.U)
+	if err != nil {
+		if debug {
+			logger("[Tap] %s refused a request to %s before decoding it", d.nodeName, methodName)
+		}
+		return nil, err
+	}
+	return &priorityCtx{Context: ctx, p: p, level: level}, nil
+}
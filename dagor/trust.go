@@ -0,0 +1,197 @@
+package dagor
+
+import (
+	"context"
+	"net"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// PeerTrust tells whether the caller of a request is a trusted internal service, whose DAGOR
+// metadata an entry service with a trust boundary passes through instead of stripping it.
+type PeerTrust func(ctx context.Context) bool
+
+// TrustNetworks trusts callers whose address is in one of the given CIDR networks.
+func TrustNetworks(cidrs ...string) (PeerTrust, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return func(ctx context.Context) bool {
+		p, ok := peer.FromContext(ctx)
+		if !ok || p.Addr == nil {
+			return false
+		}
+		addr := p.Addr
+		if t, ok := addr.(trustedAddr); ok {
+			addr = t.Addr
+		}
+		var ip net.IP
+		switch a := addr.(type) {
+		case *net.TCPAddr:
+			ip = a.IP
+		case *net.UDPAddr:
+			ip = a.IP
+		default:
+			host, _, err := net.SplitHostPort(addr.String())
+			if err != nil {
+				return false
+			}
+			ip = net.ParseIP(host)
+		}
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// TrustTLSIdentities trusts callers that authenticated with a TLS client certificate whose common name,
+// DNS SAN or URI SAN (e.g. a SPIFFE ID) is one of the given identities.
+func TrustTLSIdentities(identities ...string) PeerTrust {
+	trusted := make(map[string]bool, len(identities))
+	for _, id := range identities {
+		trusted[id] = true
+	}
+	return func(ctx context.Context) bool {
+		p, ok := peer.FromContext(ctx)
+		if !ok {
+			return false
+		}
+		info, ok := p.AuthInfo.(credentials.TLSInfo)
+		if !ok || len(info.State.PeerCertificates) == 0 {
+			return false
+		}
+		cert := info.State.PeerCertificates[0]
+		if trusted[cert.Subject.CommonName] {
+			return true
+		}
+		for _, name := range cert.DNSNames {
+			if trusted[name] {
+				return true
+			}
+		}
+		for _, uri := range cert.URIs {
+			if trusted[uri.String()] {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// TrustedListener wraps a listener reserved for internal callers, e.g. one bound to a private interface.
+// Connections accepted from it are trusted by TrustListener.
+func TrustedListener(l net.Listener) net.Listener {
+	return trustedListener{l}
+}
+
+// TrustListener trusts callers connected through a listener wrapped by TrustedListener.
+func TrustListener(ctx context.Context) bool {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return false
+	}
+	_, ok = p.Addr.(trustedAddr)
+	return ok
+}
+
+// TrustAny trusts callers trusted by any of the given checks.
+func TrustAny(checks ...PeerTrust) PeerTrust {
+	return func(ctx context.Context) bool {
+		for _, check := range checks {
+			if check(ctx) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+type trustedListener struct {
+	net.Listener
+}
+
+func (l trustedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return trustedConn{conn}, nil
+}
+
+// trustedConn marks its remote address, which gRPC reports as the peer address of the requests.
+type trustedConn struct {
+	net.Conn
+}
+
+func (c trustedConn) RemoteAddr() net.Addr {
+	return trustedAddr{c.Conn.RemoteAddr()}
+}
+
+type trustedAddr struct {
+	net.Addr
+}
+
+// enforceTrustBoundary strips the DAGOR metadata of callers outside the trust boundary of an entry service,
+// and tells whether the caller is trusted to send its own priority.
+func (d *Dagor) enforceTrustBoundary(ctx context.Context) (context.Context, bool) {
+	if !d.entryService || !d.trustBoundary {
+		return ctx, false
+	}
+	// only trusted internal callers may send their own priority or method override
+	if d.isTrustedPeer(ctx) {
+		return ctx, true
+	}
+	return d.stripDagorMetadata(ctx), false
+}
+
+// isTrustedPeer tells whether the caller is inside the trust boundary of the entry service.
+func (d *Dagor) isTrustedPeer(ctx context.Context) bool {
+	return d.trustedPeer != nil && d.trustedPeer(ctx)
+}
+
+// hasIncomingPriority tells whether the caller sent a priority, in the binary header or the legacy keys.
+func (d *Dagor) hasIncomingPriority(ctx context.Context) bool {
+	if vals := metadata.ValueFromIncomingContext(ctx, d.priorityKey); len(vals) > 0 {
+		return true
+	}
+	_, ok := incomingValue(ctx, legacyBKey)
+	return ok
+}
+
+// dagorMetadataKeys returns the DAGOR metadata keys, and the method override, an untrusted caller may not send.
+func (d *Dagor) dagorMetadataKeys() []string {
+	return []string{d.priorityKey, d.levelKey, d.signatureKey, d.businessKey, legacyBKey, legacyUKey, legacyBstarKey, legacyUstarKey, "method"}
+}
+
+// stripDagorMetadata removes all DAGOR keys, and the method override, from the incoming metadata,
+// so that nothing an untrusted caller sent reaches the sub-requests if the handler forwards the metadata.
+func (d *Dagor) stripDagorMetadata(ctx context.Context) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+	stripped := false
+	for _, key := range d.dagorMetadataKeys() {
+		if _, ok := md[key]; ok {
+			delete(md, key)
+			stripped = true
+		}
+	}
+	if !stripped {
+		return ctx
+	}
+	if debug {
+		logger("[Entry service] %s stripped DAGOR metadata sent by an untrusted caller", d.nodeName)
+	}
+	return metadata.NewIncomingContext(ctx, md)
+}
@@ -1,9 +1,13 @@
 package dagor
 
 import (
+	"context"
 	"fmt"
+	"strings"
 	"sync/atomic"
 	"time"
+
+	"google.golang.org/grpc/metadata"
 )
 
 // logger is to mock a sophisticated logging system. To simplify the example, we just print out the content.
@@ -15,36 +19,161 @@ func logger(format string, a ...interface{}) {
 	}
 }
 
+// incomingValue returns the first value of key in the incoming metadata. Key must be lower-case.
+// Unlike metadata.FromIncomingContext, only the values of key are copied.
+func incomingValue(ctx context.Context, key string) (string, bool) {
+	vals := metadata.ValueFromIncomingContext(ctx, key)
+	if len(vals) == 0 {
+		return "", false
+	}
+	return vals[0], true
+}
+
+// lastIncomingValue returns the last value of key in the incoming metadata, i.e. the one added by the closest hop.
+func lastIncomingValue(ctx context.Context, key string) (string, bool) {
+	vals := metadata.ValueFromIncomingContext(ctx, key)
+	if len(vals) == 0 {
+		return "", false
+	}
+	return vals[len(vals)-1], true
+}
+
+// outgoingValue returns the first value of key in the outgoing metadata without copying it like
+// metadata.FromOutgoingContext does. Key must be lower-case.
+func outgoingValue(ctx context.Context, key string) (string, bool) {
+	md, added, ok := metadata.FromOutgoingContextRaw(ctx)
+	if !ok {
+		return "", false
+	}
+	if vals := md[key]; len(vals) > 0 {
+		return vals[0], true
+	}
+	// neither the MD nor the appended pairs are guaranteed to have lower-case keys
+	for k, vals := range md {
+		if len(vals) > 0 && strings.EqualFold(k, key) {
+			return vals[0], true
+		}
+	}
+	for _, kv := range added {
+		for i := 0; i+1 < len(kv); i += 2 {
+			if strings.EqualFold(kv[i], key) {
+				return kv[i+1], true
+			}
+		}
+	}
+	return "", false
+}
+
+// lastOutgoingValue returns the last value of key in the outgoing metadata, i.e. the one appended most recently.
+// Key must be lower-case.
+func lastOutgoingValue(ctx context.Context, key string) (string, bool) {
+	md, added, ok := metadata.FromOutgoingContextRaw(ctx)
+	if !ok {
+		return "", false
+	}
+	for i := len(added) - 1; i >= 0; i-- {
+		kv := added[i]
+		for j := len(kv) - 2; j >= 0; j -= 2 {
+			if strings.EqualFold(kv[j], key) {
+				return kv[j+1], true
+			}
+		}
+	}
+	if vals := md[key]; len(vals) > 0 {
+		return vals[len(vals)-1], true
+	}
+	for k, vals := range md {
+		if len(vals) > 0 && strings.EqualFold(k, key) {
+			return vals[len(vals)-1], true
+		}
+	}
+	return "", false
+}
+
+// parseUint parses a small decimal number without allocating on errors like strconv.Atoi.
+func parseUint(s string) (int, bool) {
+	if len(s) == 0 || len(s) > 9 {
+		return 0, false
+	}
+	n := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int(c-'0')
+	}
+	return n, true
+}
+
+// parsePriority parses a B or U value and checks that it is in [1, max].
+func parsePriority(s string, max int) (int, bool) {
+	n, ok := parseUint(s)
+	if !ok || n < 1 || n > max {
+		return 0, false
+	}
+	return n, true
+}
+
+// randIntn returns a random int in [0, n) from the node's random source, which is not safe for concurrent use.
+func (d *Dagor) randIntn(n int) int {
+	d.rngMu.Lock()
+	defer d.rngMu.Unlock()
+	return d.rng.Intn(n)
+}
+
+// ReadNadm returns the number of admitted requests in the current window.
 func (d *Dagor) ReadNadm() int64 {
-	return atomic.LoadInt64(&d.Nadm)
+	_, Nadm := d.window.Load().Totals()
+	return Nadm
 }
 
+// UpdateNadm sets the number of admitted requests in the current window.
+//
+// Deprecated: UpdateHistogram counts the requests and AdjustAdmissionLevel starts a new window.
 func (d *Dagor) UpdateNadm(newN int64) {
-	atomic.StoreInt64(&d.Nadm, newN)
+	d.addTotals(0, newN-d.ReadNadm())
 }
 
+// IncrementNadm adds one admitted request to the current window.
+//
+// Deprecated: use UpdateHistogram, which also counts the request in N and C.
 func (d *Dagor) IncrementNadm() {
-	atomic.AddInt64(&d.Nadm, 1)
+	d.addTotals(0, 1)
 }
 
+// DecrementNadm removes one admitted request from the current window.
+//
+// Deprecated: UpdateHistogram counts the requests and AdjustAdmissionLevel starts a new window.
 func (d *Dagor) DecrementNadm() {
-	atomic.AddInt64(&d.Nadm, -1)
+	d.addTotals(0, -1)
 }
 
+// ReadN returns the number of requests in the current window.
 func (d *Dagor) ReadN() int64 {
-	return atomic.LoadInt64(&d.N)
+	N, _ := d.window.Load().Totals()
+	return N
 }
 
+// UpdateN sets the number of requests in the current window.
+//
+// Deprecated: UpdateHistogram counts the requests and AdjustAdmissionLevel starts a new window.
 func (d *Dagor) UpdateN(newN int64) {
-	atomic.StoreInt64(&d.N, newN)
+	d.addTotals(newN-d.ReadN(), 0)
 }
 
+// IncrementN adds one request to the current window.
+//
+// Deprecated: use UpdateHistogram, which also counts the request in Nadm and C.
 func (d *Dagor) IncrementN() {
-	atomic.AddInt64(&d.N, 1)
+	d.addTotals(1, 0)
 }
 
+// DecrementN removes one request from the current window.
+//
+// Deprecated: UpdateHistogram counts the requests and AdjustAdmissionLevel starts a new window.
 func (d *Dagor) DecrementN() {
-	atomic.AddInt64(&d.N, -1)
+	d.addTotals(-1, 0)
 }
 
 // CounterMatrix holds a 2D slice of atomic counters
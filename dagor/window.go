@@ -0,0 +1,236 @@
+package dagor
+
+import (
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// counters is the storage of N, Nadm and the C matrix for one window.
+type counters interface {
+	// Add records a request with priority (B, U), admitted or not.
+	Add(admitted bool, B, U int)
+	// Snapshot returns a copy of the counters.
+	Snapshot() CounterSnapshot
+	// Reset sets all counters to zero. It must not run concurrently with Add.
+	Reset()
+	// Totals returns N and Nadm, without copying the C matrix.
+	Totals() (N, Nadm int64)
+	// AddTotals adds to N and Nadm, leaving the C matrix untouched.
+	AddTotals(N, Nadm int64)
+}
+
+// matrixCounters keeps the C matrix in a CounterMatrix, with plain atomic N and Nadm.
+type matrixCounters struct {
+	n    int64
+	nadm int64
+	cm   *CounterMatrix
+}
+
+func (m *matrixCounters) Add(admitted bool, B, U int) {
+	atomic.AddInt64(&m.n, 1)
+	m.cm.Increment(B, U)
+	if admitted {
+		atomic.AddInt64(&m.nadm, 1)
+	}
+}
+
+func (m *matrixCounters) Snapshot() CounterSnapshot {
+	bMax, uMax := len(m.cm.Counters), 0
+	if bMax > 0 {
+		uMax = len(m.cm.Counters[0])
+	}
+	snap := newCounterSnapshot(bMax, uMax)
+	snap.N = atomic.LoadInt64(&m.n)
+	snap.Nadm = atomic.LoadInt64(&m.nadm)
+	for B := 1; B <= bMax; B++ {
+		for U := 1; U <= uMax; U++ {
+			snap.cells[(B-1)*uMax+(U-1)] = m.cm.Get(B, U)
+		}
+	}
+	return snap
+}
+
+func (m *matrixCounters) Totals() (int64, int64) {
+	return atomic.LoadInt64(&m.n), atomic.LoadInt64(&m.nadm)
+}
+
+func (m *matrixCounters) AddTotals(N, Nadm int64) {
+	atomic.AddInt64(&m.n, N)
+	atomic.AddInt64(&m.nadm, Nadm)
+}
+
+func (m *matrixCounters) Reset() {
+	atomic.StoreInt64(&m.n, 0)
+	atomic.StoreInt64(&m.nadm, 0)
+	m.cm.Reset()
+}
+
+// syncMapCounters keeps the C matrix in a sync.Map keyed by [2]int{B, U}.
+type syncMapCounters struct {
+	n    int64
+	nadm int64
+	bMax int
+	uMax int
+	c    sync.Map
+}
+
+func newSyncMapCounters(bMax, uMax int) *syncMapCounters {
+	m := &syncMapCounters{bMax: bMax, uMax: uMax}
+	m.Reset()
+	return m
+}
+
+func (m *syncMapCounters) Add(admitted bool, B, U int) {
+	atomic.AddInt64(&m.n, 1)
+	key := [2]int{B, U}
+	// This loop ensures that we keep trying to update the value
+	// until we are successful in case of concurrent updates
+	for {
+		// Load the current value
+		val, loaded := m.c.Load(key)
+		if !loaded {
+			// If the key doesn't exist, initialize it to 1
+			if _, loaded := m.c.LoadOrStore(key, int64(1)); !loaded {
+				break
+			}
+			continue
+		}
+		// Compare and swap the value if it's still the same; otherwise, the loop will retry
+		if m.c.CompareAndSwap(key, val, val.(int64)+1) {
+			break
+		}
+	}
+	if admitted {
+		atomic.AddInt64(&m.nadm, 1)
+	}
+}
+
+func (m *syncMapCounters) Snapshot() CounterSnapshot {
+	snap := newCounterSnapshot(m.bMax, m.uMax)
+	snap.N = atomic.LoadInt64(&m.n)
+	snap.Nadm = atomic.LoadInt64(&m.nadm)
+	m.c.Range(func(key, value interface{}) bool {
+		k := key.([2]int)
+		snap.cells[(k[0]-1)*m.uMax+(k[1]-1)] = value.(int64)
+		return true
+	})
+	return snap
+}
+
+func (m *syncMapCounters) Totals() (int64, int64) {
+	return atomic.LoadInt64(&m.n), atomic.LoadInt64(&m.nadm)
+}
+
+func (m *syncMapCounters) AddTotals(N, Nadm int64) {
+	atomic.AddInt64(&m.n, N)
+	atomic.AddInt64(&m.nadm, Nadm)
+}
+
+func (m *syncMapCounters) Reset() {
+	atomic.StoreInt64(&m.n, 0)
+	atomic.StoreInt64(&m.nadm, 0)
+	// Initialize the C matrix with the initial counters for each B, U pair
+	for B := 1; B <= m.bMax; B++ {
+		for U := 1; U <= m.uMax; U++ {
+			m.c.Store([2]int{B, U}, int64(0))
+		}
+	}
+}
+
+// inflightShard counts the increments in progress on a window, padded to its own cache line.
+type inflightShard struct {
+	n int64
+	_ cacheLinePad
+}
+
+// counterWindow holds the counters of one admission control window.
+//
+// The node keeps two windows and swaps them at the end of every window: requests record into the
+// current one while the controller computes the admission level from the other. Writers announce
+// themselves in inflight before touching the counters, so that the controller can wait for the
+// stragglers that loaded a window right before it was swapped out.
+type counterWindow struct {
+	counters
+	inflight []inflightShard
+	mask     uint32
+}
+
+func newCounterWindow(c counters) *counterWindow {
+	n := 1
+	for n < runtime.GOMAXPROCS(0) && n < maxCounterShards {
+		n <<= 1
+	}
+	return &counterWindow{counters: c, inflight: make([]inflightShard, n), mask: uint32(n - 1)}
+}
+
+// quiesce waits until no increment is in progress on the window anymore.
+func (w *counterWindow) quiesce() {
+	for i := range w.inflight {
+		for atomic.LoadInt64(&w.inflight[i].n) != 0 {
+			runtime.Gosched()
+		}
+	}
+}
+
+// newCounters creates empty counters of the type configured for the node.
+func (d *Dagor) newCounters() counters {
+	switch {
+	case d.UseShardedCounters:
+		return NewShardedCounters(d.Bmax, d.Umax)
+	case d.UseSyncMap:
+		return newSyncMapCounters(d.Bmax, d.Umax)
+	default:
+		return &matrixCounters{cm: NewCounterMatrix(d.Bmax, d.Umax)}
+	}
+}
+
+// record adds a request to the current window.
+func (d *Dagor) record(admitted bool, B, U int) {
+	for {
+		w := d.window.Load()
+		in := &w.inflight[rand.Uint32()&w.mask].n
+		atomic.AddInt64(in, 1)
+		// the window may have been swapped out between the load and the announcement, if so the
+		// controller may already be reading it and we retry on the new one
+		if d.window.Load() != w {
+			atomic.AddInt64(in, -1)
+			continue
+		}
+		w.Add(admitted, B, U)
+		atomic.AddInt64(in, -1)
+		return
+	}
+}
+
+// addTotals adds to N and Nadm of the current window, announcing itself like record.
+func (d *Dagor) addTotals(N, Nadm int64) {
+	for {
+		w := d.window.Load()
+		in := &w.inflight[rand.Uint32()&w.mask].n
+		atomic.AddInt64(in, 1)
+		if d.window.Load() != w {
+			atomic.AddInt64(in, -1)
+			continue
+		}
+		w.AddTotals(N, Nadm)
+		atomic.AddInt64(in, -1)
+		return
+	}
+}
+
+// rotateWindow publishes a fresh window and returns the previous one, once no request records into it anymore.
+// The caller owns the returned window until it hands it back with recycleWindow.
+func (d *Dagor) rotateWindow() *counterWindow {
+	old := d.window.Swap(d.spare)
+	d.spare = nil
+	old.quiesce()
+	return old
+}
+
+// recycleWindow clears a window returned by rotateWindow and keeps it for the next rotation.
+func (d *Dagor) recycleWindow(w *counterWindow) {
+	w.Reset()
+	d.spare = w
+}